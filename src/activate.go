@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -13,9 +17,12 @@ import (
 )
 
 const (
-	ActionOpen     = "open"
-	ActionCopyURL  = "copy_url"
-	ActionRefresh  = "refresh"
+	ActionOpen      = "open"
+	ActionCopyURL   = "copy_url"
+	ActionRefresh   = "refresh"
+	ActionMarkDone  = "mark_done"
+	ActionApprove   = "approve"
+	ActionUnapprove = "unapprove"
 )
 
 func Activate(single bool, identifier, action string, query string, args string, format uint8, conn net.Conn) {
@@ -28,7 +35,15 @@ func Activate(single bool, identifier, action string, query string, args string,
 		h.Remove(identifier)
 		return
 	case ActionRefresh:
-		go syncAll()
+		if !syncs.request(syncManual) {
+			slog.Info(Name, "refresh", "sync already in progress")
+		}
+		return
+	case ActionMarkDone:
+		markTodoDone(identifier)
+		return
+	case ActionApprove, ActionUnapprove:
+		setApproval(identifier, action == ActionApprove)
 		return
 	case ActionOpen:
 		url := resolveURL(identifier)
@@ -64,17 +79,141 @@ func Activate(single bool, identifier, action string, query string, args string,
 		return
 	}
 
+	// Status items aren't search results, so they stay out of the history.
+	if strings.HasPrefix(identifier, statusPrefix) {
+		return
+	}
+
+	if id, ok := strings.CutPrefix(identifier, "project:"); ok {
+		if err := recordProjectOpened(id); err != nil {
+			slog.Error(Name, "activate", err)
+		}
+	}
+
 	if config.History {
 		h.Save(query, identifier)
 	}
 }
 
 func resolveURL(identifier string) string {
+	if identifier == statusToken {
+		return tokenSettingsURL()
+	}
 	if strings.HasPrefix(identifier, "project:") {
 		return getProjectWebURL(strings.TrimPrefix(identifier, "project:"))
 	}
 	if strings.HasPrefix(identifier, "mr:") {
 		return getMRWebURL(strings.TrimPrefix(identifier, "mr:"))
 	}
+	if strings.HasPrefix(identifier, "issue:") {
+		return getIssueWebURL(strings.TrimPrefix(identifier, "issue:"))
+	}
+	if strings.HasPrefix(identifier, "todo:") {
+		return getTodoTargetURL(strings.TrimPrefix(identifier, "todo:"))
+	}
 	return ""
 }
+
+// markTodoDone marks the to-do done on GitLab and drops it from the cache
+// straight away rather than waiting for the next sync.
+func markTodoDone(identifier string) {
+	id, ok := strings.CutPrefix(identifier, "todo:")
+	if !ok {
+		slog.Error(Name, "markdone", "not a todo", "identifier", identifier)
+		return
+	}
+
+	client := apiClient.Load()
+	if client == nil {
+		slog.Error(Name, "markdone", "no GitLab client")
+		return
+	}
+
+	todoID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		slog.Error(Name, "markdone", err)
+		return
+	}
+
+	// A to-do that no longer exists was handled elsewhere, so it can go
+	// from the cache all the same.
+	if err := client.markTodoDone(context.Background(), todoID); err != nil && !errors.Is(err, ErrNotFound) {
+		slog.Error(Name, "markdone", err)
+		return
+	}
+
+	if err := deleteTodo(id); err != nil {
+		slog.Error(Name, "markdone", err)
+	}
+}
+
+// setApproval approves or unapproves an MR and refreshes its cached approval
+// state, so the other action is offered on the next query.
+func setApproval(identifier string, approve bool) {
+	id, ok := strings.CutPrefix(identifier, "mr:")
+	if !ok {
+		slog.Error(Name, "approve", "not a merge request", "identifier", identifier)
+		return
+	}
+
+	client := apiClient.Load()
+	if client == nil {
+		slog.Error(Name, "approve", "no GitLab client")
+		return
+	}
+
+	user := account.Load()
+	if user == nil {
+		slog.Error(Name, "approve", "current user not known yet")
+		return
+	}
+
+	mr, ok := getMergeRequestByID(id)
+	if !ok {
+		slog.Error(Name, "approve", "merge request not found", "identifier", identifier)
+		return
+	}
+
+	// Only call GitLab when the cache says the MR isn't in the requested
+	// state yet. Otherwise the cached state is what's stale, so just
+	// refresh it.
+	if approve != slices.Contains(mr.ApprovedBy, user.Username) {
+		var err error
+		if approve {
+			err = client.approveMergeRequest(context.Background(), mr.ProjectID, mr.IID)
+		} else {
+			err = client.unapproveMergeRequest(context.Background(), mr.ProjectID, mr.IID)
+		}
+		// GitLab answers 404 when unapproving an MR that isn't approved, in
+		// which case the cached state is stale too.
+		switch {
+		case errors.Is(err, ErrNotFound) && !approve:
+			slog.Warn(Name, "approve", err)
+		case errors.Is(err, ErrUnauthorized):
+			setTokenRejected(true)
+			slog.Error(Name, "approve", err)
+			return
+		case errors.Is(err, ErrForbidden):
+			slog.Error(Name, "approve", "not allowed to approve this merge request", "identifier", identifier)
+			return
+		case err != nil:
+			slog.Error(Name, "approve", err)
+			return
+		}
+	}
+
+	fetched := []MergeRequest{{ID: mr.ID, IID: mr.IID, ProjectID: mr.ProjectID, State: mr.State}}
+	if err := client.fetchApprovals(context.Background(), fetched); err != nil {
+		slog.Error(Name, "approve", err)
+		return
+	}
+
+	if err := setApprovals(context.Background(), mr.ID, fetched[0].Approvals); err != nil {
+		slog.Error(Name, "approve", err)
+		return
+	}
+
+	if err := loadFuzzyIndex(); err != nil {
+		slog.Error(Name, "approve", err)
+	}
+}
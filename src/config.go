@@ -10,14 +10,23 @@ import (
 )
 
 type Config struct {
-	common.Config   `koanf:",squash"`
-	GitLabURL       string `koanf:"gitlab_url" desc:"base URL of the GitLab instance" default:"https://gitlab.com"`
-	PATFile         string `koanf:"pat_file" desc:"path to file containing a GitLab personal access token" default:"~/.gitlab_pat"`
-	RefreshInterval int    `koanf:"refresh_interval" desc:"minutes between background API refreshes" default:"15"`
-	MaxProjects     int    `koanf:"max_projects" desc:"maximum number of projects to fetch" default:"1000"`
-	MembershipOnly  bool   `koanf:"membership_only" desc:"only fetch projects the user is a member of" default:"true"`
-	History         bool   `koanf:"history" desc:"enable history-based scoring" default:"true"`
-	Command         string `koanf:"command" desc:"command used to open URLs" default:"xdg-open"`
+	common.Config      `koanf:",squash"`
+	GitLabURL          string `koanf:"gitlab_url" desc:"base URL of the GitLab instance" default:"https://gitlab.com"`
+	PATFile            string `koanf:"pat_file" desc:"path to file containing a GitLab personal access token" default:"~/.gitlab_pat"`
+	RefreshInterval    int    `koanf:"refresh_interval" desc:"minutes between background API refreshes" default:"15"`
+	FullSyncInterval   int    `koanf:"full_sync_interval" desc:"minutes between full project syncs, refreshes in between only fetch recently active projects" default:"360"`
+	ProjectGracePeriod int    `koanf:"project_grace_period" desc:"minutes a project may be missing from full syncs before it is removed" default:"1440"`
+	ClosedRetention    int    `koanf:"closed_retention" desc:"days merged and closed items stay searchable with state: filters" default:"14"`
+	DrillDownProjects  int    `koanf:"drilldown_projects" desc:"number of best-matching projects listed by project!query and project#query" default:"5"`
+	ReadmeMaxAge       int    `koanf:"readme_max_age" desc:"minutes a README shown in project previews is cached" default:"1440"`
+	PipelineProjects   int    `koanf:"pipeline_projects" desc:"number of most opened projects whose default-branch pipeline is synced" default:"10"`
+	MaxProjects        int    `koanf:"max_projects" desc:"maximum number of projects to fetch" default:"1000"`
+	MaxRetries         int    `koanf:"max_retries" desc:"retries for rate-limited API requests, and for 5xx or failed ones that are safe to repeat" default:"5"`
+	FetchConcurrency   int    `koanf:"fetch_concurrency" desc:"number of project pages fetched in parallel" default:"4"`
+	MembershipOnly     bool   `koanf:"membership_only" desc:"only fetch projects the user is a member of" default:"true"`
+	IssuesMentioned    bool   `koanf:"issues_mentioned" desc:"also sync issues with a pending to-do mentioning you" default:"false"`
+	History            bool   `koanf:"history" desc:"enable history-based scoring" default:"true"`
+	Command            string `koanf:"command" desc:"command used to open URLs" default:"xdg-open"`
 }
 
 func expandPath(path string) string {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type syncTrigger int
+
+const (
+	syncBackground syncTrigger = iota
+	syncManual
+)
+
+// syncCoordinator makes sure only one sync runs at a time. Requests that
+// arrive while a sync is running are coalesced into it, except that a manual
+// refresh cancels a background sync and starts over once it has stopped, so
+// the user isn't left waiting on a sync that began before their change.
+type syncCoordinator struct {
+	sync func(ctx context.Context)
+
+	// manual is signalled on every manual sync, so that backgroundRefresh
+	// can restart its ticker.
+	manual chan struct{}
+
+	mu        sync.Mutex
+	running   bool
+	trigger   syncTrigger
+	cancel    context.CancelFunc
+	preempted bool
+}
+
+var syncs = newSyncCoordinator(syncAll)
+
+func newSyncCoordinator(fn func(ctx context.Context)) *syncCoordinator {
+	return &syncCoordinator{sync: fn, manual: make(chan struct{}, 1)}
+}
+
+// request starts a sync unless one is already running and reports whether a
+// new sync was started or scheduled.
+func (s *syncCoordinator) request(trigger syncTrigger) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if trigger == syncManual {
+		select {
+		case s.manual <- struct{}{}:
+		default:
+		}
+	}
+
+	if !s.running {
+		s.start(trigger)
+		return true
+	}
+
+	if trigger == syncManual && s.trigger == syncBackground && !s.preempted {
+		s.preempted = true
+		s.cancel()
+		return true
+	}
+
+	return false
+}
+
+// inProgress reports whether a sync is running.
+func (s *syncCoordinator) inProgress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// start runs a sync in the background. s.mu must be held.
+func (s *syncCoordinator) start(trigger syncTrigger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.running, s.trigger, s.cancel = true, trigger, cancel
+
+	go s.run(ctx)
+}
+
+func (s *syncCoordinator) run(ctx context.Context) {
+	s.sync(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancel()
+	s.running = false
+
+	if s.preempted {
+		s.preempted = false
+		s.start(syncManual)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncCoordinator_CoalescesAndPreempts(t *testing.T) {
+	var runs atomic.Int32
+	started := make(chan context.Context)
+	release := make(chan struct{})
+
+	s := newSyncCoordinator(func(ctx context.Context) {
+		runs.Add(1)
+		started <- ctx
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+	})
+
+	if !s.request(syncBackground) {
+		t.Fatal("expected the first request to start a sync")
+	}
+	background := <-started
+
+	if s.request(syncBackground) {
+		t.Error("expected a background request to be coalesced into the running sync")
+	}
+	if !s.inProgress() {
+		t.Error("expected a sync to be reported in progress")
+	}
+
+	// A manual refresh cancels the background sync and runs once it stops.
+	if !s.request(syncManual) {
+		t.Fatal("expected a manual request to preempt the background sync")
+	}
+	if s.request(syncManual) {
+		t.Error("expected a second manual request to be coalesced")
+	}
+
+	select {
+	case <-background.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the background sync to be cancelled")
+	}
+
+	manual := <-started
+	if manual.Err() != nil {
+		t.Error("expected the manual sync to run with a live context")
+	}
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for s.inProgress() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if s.inProgress() {
+		t.Error("expected no sync in progress after the manual sync finished")
+	}
+	if runs.Load() != 2 {
+		t.Errorf("expected 2 runs, got %d", runs.Load())
+	}
+}
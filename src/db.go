@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abenz1267/elephant/v2/pkg/common"
 	_ "github.com/mattn/go-sqlite3"
@@ -14,6 +19,28 @@ import (
 
 var db *sql.DB
 
+const (
+	metaProjectsSyncedAt   = "projects_synced_at"
+	metaProjectsFullSyncAt = "projects_full_synced_at"
+	metaMRsSyncedAt        = "merge_requests_synced_at"
+	metaMRsFullSyncAt      = "merge_requests_full_synced_at"
+	metaIssuesSyncedAt     = "issues_synced_at"
+	metaIssuesFullSyncAt   = "issues_full_synced_at"
+	metaTodosSyncedAt      = "todos_synced_at"
+	metaPipelinesSyncedAt  = "pipelines_synced_at"
+	metaLastSyncAt         = "last_synced_at"
+	metaLastError          = "last_error"
+	metaLastErrorAt        = "last_error_at"
+	metaSearchIndexStale   = "search_index_stale"
+)
+
+// dbOptions configures every connection. _txlock=immediate takes the write
+// lock when a transaction begins. A deferred transaction that reads before
+// writing fails with "database is locked" straight away, without waiting for
+// busy_timeout, when another process, such as the instance elephant is
+// replacing, wrote in between.
+const dbOptions = "?_journal_mode=WAL&_synchronous=NORMAL&_cache_size=10000&_temp_store=memory&_busy_timeout=5000&_txlock=immediate"
+
 func openDB() error {
 	path := common.CacheFile("gitlab.db")
 
@@ -22,50 +49,19 @@ func openDB() error {
 	}
 
 	var err error
-	db, err = sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL&_cache_size=10000&_temp_store=memory&_busy_timeout=5000")
+	db, err = sql.Open("sqlite3", path+dbOptions)
 	if err != nil {
 		return fmt.Errorf("sql open: %v", err)
 	}
 
 	db.SetMaxOpenConns(1)
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS projects (
-		id INTEGER PRIMARY KEY,
-		path_with_namespace TEXT NOT NULL,
-		name TEXT NOT NULL,
-		description TEXT DEFAULT '',
-		web_url TEXT NOT NULL,
-		namespace TEXT DEFAULT '',
-		last_activity_at INTEGER DEFAULT 0
-	)`)
-	if err != nil {
-		return fmt.Errorf("create projects table: %v", err)
-	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS merge_requests (
-		id INTEGER PRIMARY KEY,
-		iid INTEGER NOT NULL,
-		title TEXT NOT NULL,
-		description TEXT DEFAULT '',
-		web_url TEXT NOT NULL,
-		state TEXT DEFAULT 'opened',
-		source_branch TEXT DEFAULT '',
-		target_branch TEXT DEFAULT '',
-		project_path TEXT DEFAULT '',
-		author TEXT DEFAULT '',
-		role TEXT DEFAULT '',
-		created_at INTEGER DEFAULT 0
-	)`)
-	if err != nil {
-		return fmt.Errorf("create merge_requests table: %v", err)
+	if err := migrate(); err != nil {
+		return fmt.Errorf("migrate: %v", err)
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS meta (
-		key TEXT PRIMARY KEY,
-		value TEXT
-	)`)
-	if err != nil {
-		return fmt.Errorf("create meta table: %v", err)
+	if err := setupSearchIndex(); err != nil {
+		return fmt.Errorf("search index: %v", err)
 	}
 
 	return nil
@@ -77,47 +73,237 @@ func closeDB() {
 	}
 }
 
-func upsertProjects(projects []Project) error {
-	tx, err := db.Begin()
+func upsertProjects(ctx context.Context, projects []Project) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO projects
-		(id, path_with_namespace, name, description, web_url, namespace, last_activity_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	// Upsert rather than replace to keep what the API doesn't return, such
+	// as opened_count, while still clearing missing_since.
+	stmt, err := tx.Prepare(`INSERT INTO projects
+		(id, path_with_namespace, name, description, web_url, namespace, default_branch, topics, readme_url, last_activity_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			path_with_namespace = excluded.path_with_namespace, name = excluded.name,
+			description = excluded.description, web_url = excluded.web_url, namespace = excluded.namespace,
+			default_branch = excluded.default_branch, topics = excluded.topics, readme_url = excluded.readme_url,
+			last_activity_at = excluded.last_activity_at, missing_since = 0`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
+	// Renamed or transferred projects keep their id, so carry their cached
+	// MRs and issues over to the new path before replacing the row.
+	var renames []*sql.Stmt
+	for _, table := range []string{"merge_requests", "issues"} {
+		rename, err := tx.Prepare(`UPDATE ` + table + ` SET project_path = ?
+			WHERE project_path = (SELECT path_with_namespace FROM projects WHERE id = ?) AND project_path != ?`)
+		if err != nil {
+			return err
+		}
+		defer rename.Close()
+		renames = append(renames, rename)
+	}
+
 	for _, p := range projects {
-		_, err = stmt.Exec(p.ID, p.PathWithNamespace, p.Name, p.Description, p.WebURL, p.Namespace.FullPath, p.LastActivityAt.Unix())
+		for _, rename := range renames {
+			if _, err = rename.Exec(p.PathWithNamespace, p.ID, p.PathWithNamespace); err != nil {
+				return err
+			}
+		}
+
+		topics, err := json.Marshal(p.Topics)
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(p.ID, p.PathWithNamespace, p.Name, p.Description, p.WebURL, p.Namespace.FullPath,
+			p.DefaultBranch, string(topics), p.ReadmeURL, p.LastActivityAt.Unix())
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := indexProjectsTx(tx, projects); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
 	return tx.Commit()
 }
 
-func upsertMergeRequests(mrs []MergeRequest, role string) error {
-	tx, err := db.Begin()
+const (
+	roleAssigned  = "assigned"
+	roleAuthored  = "authored"
+	roleReviewing = "reviewing"
+	roleMentioned = "mentioned"
+)
+
+// mrRoles and issueRoles list the roles of each item type in display order.
+var (
+	mrRoles    = []string{roleAuthored, roleAssigned, roleReviewing}
+	issueRoles = []string{roleAuthored, roleAssigned, roleMentioned}
+)
+
+// splitRoles parses a group_concat'ed role list into the order of known.
+func splitRoles(s string, known []string) []string {
+	var roles []string
+	for _, r := range known {
+		if slices.Contains(strings.Split(s, ","), r) {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// pruneProjects marks projects absent from a full sync as missing and deletes
+// those that have been missing since before cutoff, returning their ids.
+// Projects that show up again are unmarked by upsertProjects, which replaces
+// the row.
+func pruneProjects(ctx context.Context, seen []int64, now, cutoff time.Time) ([]int64, error) {
+	ids, err := json.Marshal(seen)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE projects SET missing_since = ?
+		WHERE missing_since = 0 AND id NOT IN (SELECT value FROM json_each(?))`, now.Unix(), string(ids))
+	if err != nil {
+		return nil, fmt.Errorf("mark missing: %w", err)
+	}
+
+	rows, err := tx.Query("SELECT id FROM projects WHERE missing_since > 0 AND missing_since < ?", cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		removed = append(removed, id)
+	}
+	rows.Close()
+
+	if len(removed) == 0 {
+		return nil, tx.Commit()
+	}
+
+	if _, err := tx.Exec("DELETE FROM projects WHERE missing_since > 0 AND missing_since < ?", cutoff.Unix()); err != nil {
+		return nil, fmt.Errorf("delete missing: %w", err)
+	}
+
+	if err := pruneProjectIndexTx(tx); err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+
+	return removed, tx.Commit()
+}
+
+// mergeRequestSet is a batch of MRs fetched for a single role.
+type mergeRequestSet struct {
+	Role string
+	MRs  []MergeRequest
+}
+
+// applyMergeRequests stores every set in a single transaction so that Query
+// never observes a half-applied sync. With prune, the sets are treated as the
+// complete picture of open MRs: their roles are rebuilt, open MRs that are in
+// none of the sets are removed, and so are merged or closed MRs last updated
+// before closedBefore.
+func applyMergeRequests(ctx context.Context, sets []mergeRequestSet, prune bool, closedBefore time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	if prune {
+		_, err := tx.Exec("DELETE FROM merge_request_roles WHERE mr_id IN (SELECT id FROM merge_requests WHERE state = 'opened')")
+		if err != nil {
+			return fmt.Errorf("clear roles: %w", err)
+		}
+	}
+
+	var keep []int64
+	for _, set := range sets {
+		if err := upsertMergeRequestsTx(tx, set.MRs, set.Role); err != nil {
+			return fmt.Errorf("%s: %w", set.Role, err)
+		}
+		for _, mr := range set.MRs {
+			keep = append(keep, mr.ID)
+		}
+	}
+
+	if prune {
+		if err := pruneMergeRequestsTx(tx, keep, closedBefore); err != nil {
+			return fmt.Errorf("prune: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func upsertMergeRequests(ctx context.Context, mrs []MergeRequest, role string) error {
+	return applyMergeRequests(ctx, []mergeRequestSet{{Role: role, MRs: mrs}}, false, time.Time{})
+}
+
+// upsertMergeRequestsTx stores MRs along with the given role, if any. Roles
+// accumulate, so an MR that is both authored and reviewing keeps both. Merged
+// and closed MRs are kept with their new state so that state: filters can
+// find them until pruned.
+func upsertMergeRequestsTx(tx *sql.Tx, mrs []MergeRequest, role string) error {
+	// The MR lists carry no pipeline, so keep the status from syncPipelines
+	// unless the MR came with one.
 	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO merge_requests
-		(id, iid, title, description, web_url, state, source_branch, target_branch, project_path, author, role, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		(id, iid, project_id, title, description, web_url, state, source_branch, target_branch, project_path, author,
+		reviewers, approved_by, approvals_left, draft, labels, created_at, updated_at, pipeline_status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+			COALESCE(NULLIF(?, ''), (SELECT pipeline_status FROM merge_requests WHERE id = ?), ''))`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
+	roleStmt, err := tx.Prepare("INSERT OR IGNORE INTO merge_request_roles (mr_id, role) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer roleStmt.Close()
+
 	for _, mr := range mrs {
+		labels, err := json.Marshal(mr.Labels)
+		if err != nil {
+			return err
+		}
+
+		var reviewers, approvedBy []string
+		for _, r := range mr.Reviewers {
+			reviewers = append(reviewers, r.Username)
+		}
+		for _, a := range mr.Approvals.ApprovedBy {
+			approvedBy = append(approvedBy, a.User.Username)
+		}
+		people, err := json.Marshal(reviewers)
+		if err != nil {
+			return err
+		}
+		approvers, err := json.Marshal(approvedBy)
+		if err != nil {
+			return err
+		}
+
 		projectPath := ""
 		if mr.References.Full != "" {
 			// Extract project path from full reference like "group/project!123"
@@ -127,21 +313,83 @@ func upsertMergeRequests(mrs []MergeRequest, role string) error {
 			}
 		}
 
-		_, err = stmt.Exec(mr.ID, mr.IID, mr.Title, mr.Description, mr.WebURL, mr.State,
-			mr.SourceBranch, mr.TargetBranch, projectPath, mr.Author.Username, role, mr.CreatedAt.Unix())
+		_, err = stmt.Exec(mr.ID, mr.IID, mr.ProjectID, mr.Title, mr.Description, mr.WebURL, mr.State,
+			mr.SourceBranch, mr.TargetBranch, projectPath, mr.Author.Username,
+			string(people), string(approvers), mr.Approvals.ApprovalsLeft, mr.Draft, string(labels),
+			mr.CreatedAt.Unix(), mr.UpdatedAt.Unix(), mr.HeadPipeline.Status, mr.ID)
 		if err != nil {
 			return err
 		}
+
+		if role == "" {
+			continue
+		}
+		if _, err = roleStmt.Exec(mr.ID, role); err != nil {
+			return err
+		}
 	}
 
-	return tx.Commit()
+	if err := indexMergeRequestsTx(tx, mrs); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	return nil
+}
+
+// pruneMergeRequestsTx deletes open MRs whose id is not in keep, and merged
+// or closed MRs last updated before closedBefore.
+func pruneMergeRequestsTx(tx *sql.Tx, keep []int64, closedBefore time.Time) error {
+	ids, err := json.Marshal(keep)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM merge_requests WHERE
+		(state = 'opened' AND id NOT IN (SELECT value FROM json_each(?))) OR
+		(state != 'opened' AND updated_at < ?)`, string(ids), closedBefore.Unix())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM merge_request_roles WHERE mr_id NOT IN (SELECT id FROM merge_requests)")
+	if err != nil {
+		return err
+	}
+
+	return pruneMergeRequestIndexTx(tx)
+}
+
+func getMeta(key string) (string, bool) {
+	var value string
+	err := db.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		return "", false
+	}
+	return value, true
 }
 
-func clearMergeRequests() error {
-	_, err := db.Exec("DELETE FROM merge_requests")
+func setMeta(ctx context.Context, key, value string) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", key, value)
 	return err
 }
 
+func getMetaTime(key string) (time.Time, bool) {
+	value, ok := getMeta(key)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	unix, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+func setMetaTime(ctx context.Context, key string, t time.Time) error {
+	return setMeta(ctx, key, strconv.FormatInt(t.Unix(), 10))
+}
+
 func lastIndex(s string, c byte) int {
 	for i := len(s) - 1; i >= 0; i-- {
 		if s[i] == c {
@@ -158,22 +406,34 @@ type dbProject struct {
 	Description       string
 	WebURL            string
 	Namespace         string
+	DefaultBranch     string
+	Topics            []string
+	ReadmeURL         string
+	PipelineStatus    string
 	LastActivityAt    int64
 }
 
 type dbMergeRequest struct {
-	ID           int64
-	IID          int64
-	Title        string
-	Description  string
-	WebURL       string
-	State        string
-	SourceBranch string
-	TargetBranch string
-	ProjectPath  string
-	Author       string
-	Role         string
-	CreatedAt    int64
+	ID             int64
+	IID            int64
+	ProjectID      int64
+	Title          string
+	Description    string
+	WebURL         string
+	State          string
+	SourceBranch   string
+	TargetBranch   string
+	ProjectPath    string
+	Author         string
+	Roles          []string
+	Reviewers      []string
+	ApprovedBy     []string
+	ApprovalsLeft  int
+	PipelineStatus string
+	Draft          bool
+	Labels         []string
+	CreatedAt      int64
+	UpdatedAt      int64
 }
 
 func queryProjects(query string) []dbProject {
@@ -185,15 +445,15 @@ func queryProjects(query string) []dbProject {
 		where := make([]string, len(words))
 		args := make([]any, 0, len(words)*2)
 		for i, w := range words {
-			like := "%" + w + "%"
-			where[i] = "(path_with_namespace LIKE ? OR name LIKE ?)"
-			args = append(args, like, like)
+			clause, wordArgs := matchWord("projects_fts", []string{"path_with_namespace", "name", "description"}, w)
+			where[i] = clause
+			args = append(args, wordArgs...)
 		}
-		rows, err = db.Query(`SELECT id, path_with_namespace, name, description, web_url, namespace, last_activity_at
+		rows, err = db.Query(`SELECT `+projectColumns+`
 			FROM projects WHERE `+strings.Join(where, " AND ")+`
 			ORDER BY last_activity_at DESC LIMIT 200`, args...)
 	} else {
-		rows, err = db.Query(`SELECT id, path_with_namespace, name, description, web_url, namespace, last_activity_at
+		rows, err = db.Query(`SELECT ` + projectColumns + `
 			FROM projects ORDER BY last_activity_at DESC LIMIT 50`)
 	}
 
@@ -201,64 +461,274 @@ func queryProjects(query string) []dbProject {
 		slog.Error(Name, "queryprojects", err)
 		return nil
 	}
+
+	return scanProjects(rows)
+}
+
+// attentionOrder is attentionRank and sortByAttention as an ORDER BY clause,
+// taking roleReviewing and roleAssigned as arguments.
+const attentionOrder = `CASE
+		WHEN draft THEN 3
+		WHEN EXISTS (SELECT 1 FROM merge_request_roles r WHERE r.mr_id = merge_requests.id AND r.role = ?) THEN 0
+		WHEN EXISTS (SELECT 1 FROM merge_request_roles r WHERE r.mr_id = merge_requests.id AND r.role = ?) THEN 1
+		ELSE 2
+	END, MAX(updated_at, created_at) DESC`
+
+// queryMergeRequestsForProjects returns MRs in the given projects, or in
+// every project when projectPaths is nil, that match every word of query and
+// pass filter. Across every project only MRs holding a role are listed, which
+// leaves out those cached by looking up a reference.
+func queryMergeRequestsForProjects(projectPaths []string, query string, filter itemFilter) []dbMergeRequest {
+	where := "1"
+	var args []any
+
+	if projectPaths != nil {
+		if len(projectPaths) == 0 {
+			return nil
+		}
+		where = "project_path IN (" + placeholders(len(projectPaths)) + ")"
+		args = appendAll(args, projectPaths)
+	} else {
+		where = "EXISTS (SELECT 1 FROM merge_request_roles r WHERE r.mr_id = merge_requests.id)"
+	}
+
+	for _, w := range strings.Fields(query) {
+		clause, wordArgs := matchWord("merge_requests_fts", []string{"title", "source_branch", "description"}, w)
+		where += " AND (" + clause + " OR CAST(iid AS TEXT) LIKE ?)"
+		args = append(append(args, wordArgs...), "%"+w+"%")
+	}
+
+	clause, filterArgs := filter.where("merge_requests", "merge_request_roles", "mr_id")
+	where += clause
+	args = append(args, filterArgs...)
+
+	if filter.draft != nil {
+		where += " AND draft = ?"
+		args = append(args, *filter.draft)
+	}
+
+	if len(filter.pipelines) > 0 {
+		where += " AND pipeline_status IN (" + placeholders(len(filter.pipelines)) + ")"
+		args = appendAll(args, filter.pipelines)
+	}
+
+	// Without a query the list is shown in attention order, so apply it
+	// before the limit rather than dropping older MRs that need a review.
+	order := "created_at DESC"
+	if query == "" {
+		order = attentionOrder
+		args = append(args, roleReviewing, roleAssigned)
+	}
+
+	rows, err := db.Query(`SELECT `+mergeRequestColumns+`
+		FROM merge_requests WHERE `+where+`
+		ORDER BY `+order+` LIMIT 200`, args...)
+	if err != nil {
+		slog.Error(Name, "querymergerequestsforprojects", err)
+		return nil
+	}
+
+	return scanMergeRequests(rows)
+}
+
+// allProjects returns every cached project for the in-memory fuzzy index.
+func allProjects() ([]dbProject, error) {
+	rows, err := db.Query(`SELECT ` + projectColumns + ` FROM projects ORDER BY last_activity_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanProjects(rows), nil
+}
+
+// allMergeRequests returns every cached MR for the in-memory fuzzy index.
+func allMergeRequests() ([]dbMergeRequest, error) {
+	rows, err := db.Query(`SELECT ` + mergeRequestColumns + ` FROM merge_requests ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanMergeRequests(rows), nil
+}
+
+const projectColumns = `id, path_with_namespace, name, description, web_url, namespace,
+	default_branch, topics, readme_url, pipeline_status, last_activity_at`
+
+const mergeRequestColumns = `id, iid, project_id, title, description, web_url, state, source_branch, target_branch, project_path, author,
+	(SELECT group_concat(role) FROM merge_request_roles WHERE mr_id = merge_requests.id),
+	reviewers, approved_by, approvals_left, pipeline_status, draft, labels, created_at, updated_at`
+
+func scanProjects(rows *sql.Rows) []dbProject {
 	defer rows.Close()
 
 	var result []dbProject
 	for rows.Next() {
 		var p dbProject
-		if err := rows.Scan(&p.ID, &p.PathWithNamespace, &p.Name, &p.Description, &p.WebURL, &p.Namespace, &p.LastActivityAt); err != nil {
+		var topics string
+		if err := rows.Scan(&p.ID, &p.PathWithNamespace, &p.Name, &p.Description, &p.WebURL, &p.Namespace,
+			&p.DefaultBranch, &topics, &p.ReadmeURL, &p.PipelineStatus, &p.LastActivityAt); err != nil {
 			continue
 		}
+		json.Unmarshal([]byte(topics), &p.Topics)
 		result = append(result, p)
 	}
 
 	return result
 }
 
+func scanMergeRequests(rows *sql.Rows) []dbMergeRequest {
+	defer rows.Close()
+
+	var result []dbMergeRequest
+	for rows.Next() {
+		var mr dbMergeRequest
+		var roles sql.NullString
+		var reviewers, approvedBy, labels string
+		if err := rows.Scan(&mr.ID, &mr.IID, &mr.ProjectID, &mr.Title, &mr.Description, &mr.WebURL, &mr.State,
+			&mr.SourceBranch, &mr.TargetBranch, &mr.ProjectPath, &mr.Author, &roles,
+			&reviewers, &approvedBy, &mr.ApprovalsLeft, &mr.PipelineStatus, &mr.Draft, &labels, &mr.CreatedAt, &mr.UpdatedAt); err != nil {
+			continue
+		}
+		mr.Roles = splitRoles(roles.String, mrRoles)
+		json.Unmarshal([]byte(reviewers), &mr.Reviewers)
+		json.Unmarshal([]byte(approvedBy), &mr.ApprovedBy)
+		json.Unmarshal([]byte(labels), &mr.Labels)
+		result = append(result, mr)
+	}
+
+	return result
+}
+
+// recordProjectOpened counts how often a project is opened, which decides
+// whose default-branch pipeline is synced.
+func recordProjectOpened(id string) error {
+	_, err := db.Exec("UPDATE projects SET opened_count = opened_count + 1 WHERE id = ?", id)
+	return err
+}
 
-func queryMergeRequestsForProjects(projectPaths []string, query string) []dbMergeRequest {
-	if len(projectPaths) == 0 {
+// mostOpenedProjects returns up to n projects that have been opened at least
+// once, most opened first.
+func mostOpenedProjects(n int) []dbProject {
+	rows, err := db.Query(`SELECT `+projectColumns+` FROM projects
+		WHERE opened_count > 0 ORDER BY opened_count DESC LIMIT ?`, n)
+	if err != nil {
+		slog.Error(Name, "mostopenedprojects", err)
 		return nil
 	}
 
-	placeholders := make([]string, len(projectPaths))
-	args := make([]any, len(projectPaths))
-	for i, p := range projectPaths {
-		placeholders[i] = "?"
-		args[i] = p
+	return scanProjects(rows)
+}
+
+// setPipelineStatuses stores the pipeline statuses of MRs and projects, keyed
+// by id, in a single transaction.
+func setPipelineStatuses(ctx context.Context, mrs, projects map[int64]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	where := "project_path IN (" + strings.Join(placeholders, ",") + ")"
+	for table, statuses := range map[string]map[int64]string{"merge_requests": mrs, "projects": projects} {
+		stmt, err := tx.Prepare("UPDATE " + table + " SET pipeline_status = ? WHERE id = ?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
 
-	if query != "" {
-		words := strings.Fields(query)
-		for _, w := range words {
-			like := "%" + w + "%"
-			where += " AND (title LIKE ? OR source_branch LIKE ? OR CAST(iid AS TEXT) LIKE ?)"
-			args = append(args, like, like, like)
+		for id, status := range statuses {
+			if _, err := stmt.Exec(status, id); err != nil {
+				return err
+			}
 		}
 	}
 
-	rows, err := db.Query(`SELECT id, iid, title, description, web_url, state, source_branch, target_branch, project_path, author, role, created_at
-		FROM merge_requests WHERE `+where+`
-		ORDER BY created_at DESC LIMIT 200`, args...)
+	return tx.Commit()
+}
+
+func getProjectByPath(path string) (dbProject, bool) {
+	rows, err := db.Query(`SELECT `+projectColumns+` FROM projects WHERE path_with_namespace = ?`, path)
 	if err != nil {
-		slog.Error(Name, "querymergerequestsforprojects", err)
-		return nil
+		slog.Error(Name, "getprojectbypath", err)
+		return dbProject{}, false
+	}
+
+	projects := scanProjects(rows)
+	if len(projects) == 0 {
+		return dbProject{}, false
+	}
+	return projects[0], true
+}
+
+func getMergeRequestByID(id string) (dbMergeRequest, bool) {
+	rows, err := db.Query(`SELECT `+mergeRequestColumns+` FROM merge_requests WHERE id = ?`, id)
+	if err != nil {
+		slog.Error(Name, "getmergerequestbyid", err)
+		return dbMergeRequest{}, false
+	}
+
+	mrs := scanMergeRequests(rows)
+	if len(mrs) == 0 {
+		return dbMergeRequest{}, false
+	}
+	return mrs[0], true
+}
+
+// setApprovals replaces the cached approval state of an MR.
+func setApprovals(ctx context.Context, id int64, approvals MRApprovals) error {
+	var approvedBy []string
+	for _, a := range approvals.ApprovedBy {
+		approvedBy = append(approvedBy, a.User.Username)
+	}
+	data, err := json.Marshal(approvedBy)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE merge_requests SET approved_by = ?, approvals_left = ? WHERE id = ?",
+		string(data), approvals.ApprovalsLeft, id)
+	return err
+}
+
+// cachedApprovals returns the cached approval state of every MR by ID, for
+// keeping it when fetching fresh approvals fails.
+func cachedApprovals() (map[int64]MRApprovals, error) {
+	rows, err := db.Query("SELECT id, approved_by, approvals_left FROM merge_requests")
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	var result []dbMergeRequest
+	approvals := make(map[int64]MRApprovals)
 	for rows.Next() {
-		var mr dbMergeRequest
-		if err := rows.Scan(&mr.ID, &mr.IID, &mr.Title, &mr.Description, &mr.WebURL, &mr.State,
-			&mr.SourceBranch, &mr.TargetBranch, &mr.ProjectPath, &mr.Author, &mr.Role, &mr.CreatedAt); err != nil {
-			continue
+		var id int64
+		var approvedBy string
+		var a MRApprovals
+		if err := rows.Scan(&id, &approvedBy, &a.ApprovalsLeft); err != nil {
+			return nil, err
 		}
-		result = append(result, mr)
+		var usernames []string
+		json.Unmarshal([]byte(approvedBy), &usernames)
+		for _, u := range usernames {
+			a.ApprovedBy = append(a.ApprovedBy, MRApproval{User: MRAuthor{Username: u}})
+		}
+		approvals[id] = a
 	}
 
-	return result
+	return approvals, rows.Err()
+}
+
+func getMergeRequestByReference(projectPath string, iid int64) (dbMergeRequest, bool) {
+	rows, err := db.Query(`SELECT `+mergeRequestColumns+` FROM merge_requests WHERE project_path = ? AND iid = ?`, projectPath, iid)
+	if err != nil {
+		slog.Error(Name, "getmergerequestbyreference", err)
+		return dbMergeRequest{}, false
+	}
+
+	mrs := scanMergeRequests(rows)
+	if len(mrs) == 0 {
+		return dbMergeRequest{}, false
+	}
+	return mrs[0], true
 }
 
 func getProjectWebURL(id string) string {
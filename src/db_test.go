@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func countMergeRequests(t *testing.T) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM merge_requests").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUpsertMergeRequests_ReconcilesState(t *testing.T) {
+	setupTestDB(t)
+
+	before := countMergeRequests(t)
+
+	err := upsertMergeRequests(t.Context(), []MergeRequest{
+		{ID: 100, IID: 620, Title: "fix: bump retry timeout for background jobs", State: "merged"},
+		{ID: 200, IID: 700, Title: "feat: new thing", State: "opened"},
+	}, "authored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after := countMergeRequests(t); after != before+1 {
+		t.Errorf("expected %d merge requests after merging one and opening one, got %d", before+1, after)
+	}
+
+	var state string
+	if err := db.QueryRow("SELECT state FROM merge_requests WHERE id = 100").Scan(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state != "merged" {
+		t.Errorf("expected merged MR to be kept as merged, got %q", state)
+	}
+}
+
+func TestApplyMergeRequests_Prune(t *testing.T) {
+	setupTestDB(t)
+
+	sets := []mergeRequestSet{
+		{Role: "authored", MRs: []MergeRequest{{ID: 100, IID: 620, Title: "a", State: "opened"}}},
+		{Role: "reviewing", MRs: []MergeRequest{{ID: 102, IID: 17, Title: "b", State: "opened"}}},
+	}
+	if err := applyMergeRequests(t.Context(), sets, true, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countMergeRequests(t); n != 2 {
+		t.Errorf("expected 2 merge requests after prune, got %d", n)
+	}
+}
+
+func TestApplyMergeRequests_RollsBackOnError(t *testing.T) {
+	setupTestDB(t)
+
+	before := countMergeRequests(t)
+
+	// Make the second set fail so the first one must be rolled back too.
+	if _, err := db.Exec("CREATE TRIGGER fail_reviewing BEFORE INSERT ON merge_request_roles WHEN NEW.role = 'reviewing' BEGIN SELECT RAISE(ABORT, 'boom'); END"); err != nil {
+		t.Fatal(err)
+	}
+
+	sets := []mergeRequestSet{
+		{Role: "authored", MRs: []MergeRequest{{ID: 200, IID: 1, Title: "a", State: "opened"}}},
+		{Role: "reviewing", MRs: []MergeRequest{{ID: 201, IID: 2, Title: "b", State: "opened"}}},
+	}
+	if err := applyMergeRequests(t.Context(), sets, true, time.Time{}); err == nil {
+		t.Fatal("expected an error from the failing trigger")
+	}
+
+	if after := countMergeRequests(t); after != before {
+		t.Errorf("expected the cache to be untouched (%d), got %d merge requests", before, after)
+	}
+}
+
+func TestApplyMergeRequests_Cancelled(t *testing.T) {
+	setupTestDB(t)
+
+	before := countMergeRequests(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	sets := []mergeRequestSet{{Role: "authored", MRs: []MergeRequest{{ID: 200, IID: 1, Title: "a", State: "opened"}}}}
+	if err := applyMergeRequests(ctx, sets, true, time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if after := countMergeRequests(t); after != before {
+		t.Errorf("expected the cache to be untouched (%d), got %d merge requests", before, after)
+	}
+}
+
+func TestDBOptions_ConcurrentWriters(t *testing.T) {
+	// Two handles on one file stand in for the instance elephant is
+	// replacing and the one taking over.
+	path := filepath.Join(t.TempDir(), "gitlab.db")
+	open := func() *sql.DB {
+		d, err := sql.Open("sqlite3", path+dbOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.SetMaxOpenConns(1)
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+	old, current := open(), open()
+
+	// Don't make the test wait the full busy_timeout for the lock.
+	if _, err := old.Exec("PRAGMA busy_timeout = 100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := current.Exec("CREATE TABLE meta (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction that reads before it writes, like a migration, holds
+	// the write lock from the start.
+	tx, err := current.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM meta").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	// So the other instance can't write in between...
+	insert := "INSERT INTO meta (key, value) VALUES ('a', '1')"
+	if _, err := old.Exec(insert); err == nil {
+		t.Fatal("expected the other write to wait for the lock")
+	}
+
+	// ...which would make this write fail with "database is locked".
+	if _, err := tx.Exec("INSERT INTO meta (key, value) VALUES ('b', '2')"); err != nil {
+		t.Fatalf("expected the transaction to keep its write lock, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.Exec(insert); err != nil {
+		t.Errorf("expected the other write to go through after the commit, got %v", err)
+	}
+}
+
+// Runs with and without the sqlite_fts5 tag, so that both search paths
+// cover descriptions.
+func TestSearchIndex_ProjectDescription(t *testing.T) {
+	setupTestDB(t)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 9, PathWithNamespace: "legalcorp/contracts", Name: "contracts",
+		Description: "Document pipeline for signed agreements", WebURL: "https://git.example.com/legalcorp/contracts",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projects := queryProjects("agreements")
+	if len(projects) != 1 || projects[0].ID != 9 {
+		t.Errorf("expected project 9 to match on its description, got %+v", projects)
+	}
+}
+
+func TestSearchIndex_RebuildsAfterBuildWithoutFTS(t *testing.T) {
+	setupTestDB(t)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 9, PathWithNamespace: "legalcorp/contracts", Name: "contracts",
+		Description: "Document pipeline for signed agreements", WebURL: "https://git.example.com/legalcorp/contracts",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A build without FTS5 changes the description without updating the
+	// index, leaving the row counts equal.
+	if _, err := db.Exec("UPDATE projects SET description = 'Ledger for outstanding invoices' WHERE id = 9"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(t.Context(), metaSearchIndexStale, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setupSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	projects := queryProjects("invoices")
+	if len(projects) != 1 || projects[0].ID != 9 {
+		t.Errorf("expected project 9 to match on its new description, got %+v", projects)
+	}
+
+	stale, _ := getMeta(metaSearchIndexStale)
+	if ftsEnabled && stale != "" {
+		t.Error("expected the rebuild to clear the stale flag")
+	}
+	if !ftsEnabled && stale == "" {
+		t.Error("expected a build without FTS5 to flag the index as stale")
+	}
+}
+
+func TestPruneProjects_GracePeriod(t *testing.T) {
+	setupTestDB(t)
+
+	seen := []int64{1, 2, 3, 4, 5, 6, 7}
+	now := time.Unix(10_000, 0)
+
+	// Project 8 goes missing but is still within the grace period.
+	removed, err := pruneProjects(t.Context(), seen, now, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("expected nothing removed within grace period, got %v", removed)
+	}
+
+	// Still missing two hours later, past the grace period.
+	later := now.Add(2 * time.Hour)
+	removed, err = pruneProjects(t.Context(), seen, later, later.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != 8 {
+		t.Fatalf("expected project 8 removed, got %v", removed)
+	}
+
+	if url := getProjectWebURL("8"); url != "" {
+		t.Errorf("expected project 8 to be deleted, still has url %q", url)
+	}
+}
+
+func TestPruneProjects_Reappears(t *testing.T) {
+	setupTestDB(t)
+
+	now := time.Unix(10_000, 0)
+	if _, err := pruneProjects(t.Context(), []int64{1}, now, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Project 2 comes back (e.g. access restored) before the grace period ends.
+	if err := upsertProjects(t.Context(), []Project{{ID: 2, PathWithNamespace: "researchable/sdv", Name: "sdv", WebURL: "u"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	later := now.Add(2 * time.Hour)
+	removed, err := pruneProjects(t.Context(), []int64{1}, later, later.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(removed, 2) {
+		t.Errorf("expected project 2 to survive after reappearing, removed %v", removed)
+	}
+}
+
+func TestUpsertProjects_RenameMovesMergeRequests(t *testing.T) {
+	setupTestDB(t)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 3, PathWithNamespace: "researchable/platform/researchable-infrastructure",
+		Name: "researchable-infrastructure", WebURL: "https://git.example.com/researchable/platform/researchable-infrastructure",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mrs := queryMergeRequestsForProjects([]string{"researchable/platform/researchable-infrastructure"}, "", itemFilter{})
+	if len(mrs) != 2 {
+		t.Errorf("expected both MRs to follow the renamed project, got %d", len(mrs))
+	}
+}
+
+func TestUpsertProjects_RenameMovesIssues(t *testing.T) {
+	setupTestDB(t)
+
+	err := applyIssues(t.Context(), []issueSet{{Role: roleAssigned, Issues: []Issue{{
+		ID: 300, IID: 12, Title: "rotate TLS certificates", State: "opened",
+		References: MRReferences{Full: "researchable/general/researchable-infrastructure#12"},
+	}}}}, false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upsertProjects(t.Context(), []Project{{
+		ID: 3, PathWithNamespace: "researchable/platform/researchable-infrastructure",
+		Name: "researchable-infrastructure", WebURL: "https://git.example.com/researchable/platform/researchable-infrastructure",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := getIssueByReference("researchable/platform/researchable-infrastructure", 12); !ok {
+		t.Error("expected the issue to follow the renamed project")
+	}
+	issues := queryIssuesForProjects([]string{"researchable/platform/researchable-infrastructure"}, "", itemFilter{})
+	if len(issues) != 1 {
+		t.Errorf("expected the issue in the renamed project's list, got %d", len(issues))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Errors that API failures wrap, so that callers can tell a rejected token
+// from a flaky server with errors.Is.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServerError  = errors.New("server error")
+)
+
+// APIError is returned for a response with a non-2xx status. It carries the
+// message GitLab sent along, if any.
+type APIError struct {
+	Method   string
+	Endpoint string
+	Status   int
+	Message  string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Endpoint, e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Unwrap maps the status to one of the Err values.
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.Status == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.Status == http.StatusForbidden:
+		return ErrForbidden
+	case e.Status == http.StatusNotFound:
+		return ErrNotFound
+	case e.Status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.Status >= http.StatusInternalServerError:
+		return ErrServerError
+	}
+	return nil
+}
+
+// checkResponse returns an *APIError for a non-2xx response, reading GitLab's
+// "message" or "error" field from the body.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err := &APIError{Method: resp.Request.Method, Endpoint: resp.Request.URL.Path, Status: resp.StatusCode}
+
+	var payload struct {
+		Message any    `json:"message"`
+		Error   string `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(body, &payload) == nil {
+		switch m := payload.Message.(type) {
+		case string:
+			err.Message = m
+		case nil:
+			err.Message = payload.Error
+		default:
+			data, _ := json.Marshal(m)
+			err.Message = string(data)
+		}
+	}
+
+	// GitLab often just repeats the status, e.g. "401 Unauthorized".
+	if strings.TrimPrefix(err.Message, fmt.Sprintf("%d ", resp.StatusCode)) == http.StatusText(resp.StatusCode) {
+		err.Message = ""
+	}
+
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// itemFilter holds the key:value terms parsed out of a query, such as
+// "role:reviewing" or "label:backend". Repeated terms for the same key are
+// alternatives, except for labels which must all be present.
+type itemFilter struct {
+	kinds     []string
+	roles     []string
+	authors   []string
+	states    []string
+	labels    []string
+	pipelines []string
+	draft     *bool
+}
+
+const (
+	kindProject = "project"
+	kindMR      = "mr"
+	kindIssue   = "issue"
+	kindTodo    = "todo"
+)
+
+// parseFilter splits query into its free text and filter terms. Terms may
+// also directly follow the "!" or "#" separator, as in "infra!role:reviewing".
+// Unknown keys and invalid values are left in the text.
+func parseFilter(query string) (string, itemFilter) {
+	var f itemFilter
+	var words []string
+
+	for _, w := range strings.Fields(query) {
+		prefix := ""
+		if i := strings.LastIndexAny(w, "!#"); i >= 0 {
+			prefix, w = w[:i+1], w[i+1:]
+		}
+
+		key, value, ok := strings.Cut(w, ":")
+		if !ok || value == "" || !f.add(strings.ToLower(key), value) {
+			words = append(words, prefix+w)
+			continue
+		}
+
+		if prefix != "" {
+			words = append(words, prefix)
+		}
+	}
+
+	return strings.Join(words, " "), f
+}
+
+// add records a single term and reports whether key and value were valid.
+func (f *itemFilter) add(key, value string) bool {
+	lower := strings.ToLower(value)
+
+	switch key {
+	case "is":
+		switch lower {
+		case "project", "projects":
+			f.kinds = append(f.kinds, kindProject)
+		case "mr", "mrs", "merge_request":
+			f.kinds = append(f.kinds, kindMR)
+		case "issue", "issues":
+			f.kinds = append(f.kinds, kindIssue)
+		case "todo", "todos":
+			f.kinds = append(f.kinds, kindTodo)
+		default:
+			return false
+		}
+	case "role":
+		f.roles = append(f.roles, lower)
+	case "author":
+		f.authors = append(f.authors, strings.TrimPrefix(value, "@"))
+	case "state":
+		if lower == "open" {
+			lower = "opened"
+		}
+		f.states = append(f.states, lower)
+	case "draft":
+		switch lower {
+		case "true", "yes":
+			f.draft = new(bool)
+			*f.draft = true
+		case "false", "no":
+			f.draft = new(bool)
+		default:
+			return false
+		}
+	case "label":
+		f.labels = append(f.labels, value)
+	case "pipeline":
+		f.pipelines = append(f.pipelines, lower)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// hasItemTerms reports whether the filter restricts MRs or issues.
+func (f itemFilter) hasItemTerms() bool {
+	return len(f.roles) > 0 || len(f.authors) > 0 || len(f.states) > 0 || len(f.labels) > 0 ||
+		len(f.pipelines) > 0 || f.draft != nil
+}
+
+// wants reports whether items of kind should be listed. Without is: terms
+// every kind is wanted.
+func (f itemFilter) wants(kind string) bool {
+	return len(f.kinds) == 0 || slices.Contains(f.kinds, kind)
+}
+
+// matchState reports whether state passes the filter. Only open items match
+// unless a state: term says otherwise; "state:all" matches everything.
+func (f itemFilter) matchState(state string) bool {
+	if len(f.states) == 0 {
+		return state == "opened"
+	}
+	return slices.Contains(f.states, "all") || slices.Contains(f.states, state)
+}
+
+func (f itemFilter) matchMergeRequest(mr dbMergeRequest) bool {
+	return f.matchState(mr.State) &&
+		hasAnyRole(mr.Roles, f.roles) &&
+		f.matchAuthor(mr.Author) &&
+		f.matchLabels(mr.Labels) &&
+		(len(f.pipelines) == 0 || slices.Contains(f.pipelines, mr.PipelineStatus)) &&
+		(f.draft == nil || *f.draft == mr.Draft)
+}
+
+// matchIssue is the issue counterpart of matchMergeRequest. Issues are never
+// drafts and have no pipelines.
+func (f itemFilter) matchIssue(issue dbIssue) bool {
+	return len(f.pipelines) == 0 &&
+		f.matchState(issue.State) &&
+		hasAnyRole(issue.Roles, f.roles) &&
+		f.matchAuthor(issue.Author) &&
+		f.matchLabels(issue.Labels) &&
+		(f.draft == nil || !*f.draft)
+}
+
+func (f itemFilter) matchAuthor(author string) bool {
+	return len(f.authors) == 0 || slices.ContainsFunc(f.authors, func(a string) bool { return strings.EqualFold(a, author) })
+}
+
+func (f itemFilter) matchLabels(labels []string) bool {
+	for _, want := range f.labels {
+		if !slices.ContainsFunc(labels, func(l string) bool { return strings.EqualFold(l, want) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// where returns the SQL counterpart of matchMergeRequest and matchIssue for
+// the given table and its role table, to be ANDed onto a WHERE clause.
+func (f itemFilter) where(table, roleTable, roleKey string) (string, []any) {
+	var clause string
+	var args []any
+
+	switch {
+	case len(f.states) == 0:
+		clause += " AND state = 'opened'"
+	case !slices.Contains(f.states, "all"):
+		clause += " AND state IN (" + placeholders(len(f.states)) + ")"
+		args = appendAll(args, f.states)
+	}
+
+	if len(f.roles) > 0 {
+		clause += " AND EXISTS (SELECT 1 FROM " + roleTable + " r WHERE r." + roleKey + " = " + table + ".id AND r.role IN (" +
+			placeholders(len(f.roles)) + "))"
+		args = appendAll(args, f.roles)
+	}
+
+	if len(f.authors) > 0 {
+		clause += " AND author COLLATE NOCASE IN (" + placeholders(len(f.authors)) + ")"
+		args = appendAll(args, f.authors)
+	}
+
+	for _, l := range f.labels {
+		clause += " AND EXISTS (SELECT 1 FROM json_each(" + table + ".labels) WHERE value = ? COLLATE NOCASE)"
+		args = append(args, l)
+	}
+
+	return clause, args
+}
+
+func placeholders(n int) string {
+	return strings.Repeat("?,", n-1) + "?"
+}
+
+func appendAll[T any](args []any, values []T) []any {
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return args
+}
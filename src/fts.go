@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ftsEnabled reports whether the FTS5 search index is available. FTS5 is only
+// compiled into go-sqlite3 with the sqlite_fts5 build tag; without it queries
+// fall back to LIKE scans.
+var ftsEnabled bool
+
+// setupSearchIndex creates the trigram FTS5 tables and rebuilds them when they
+// may be out of step with the base tables: when their row counts differ, e.g.
+// on first use, or when a build without FTS5 has written to the cache since,
+// which it records in metaSearchIndexStale.
+func setupSearchIndex() error {
+	var available bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available); err != nil {
+		return fmt.Errorf("check fts5: %w", err)
+	}
+	if !available {
+		slog.Info(Name, "search", "fts5 not available, using LIKE")
+		ftsEnabled = false
+		// Nothing keeps the index up to date from here on, so have the next
+		// build with FTS5 rebuild it.
+		return setMeta(context.Background(), metaSearchIndexStale, "1")
+	}
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS projects_fts USING fts5(
+		path_with_namespace, name, description, tokenize = 'trigram'
+	)`)
+	if err != nil {
+		return fmt.Errorf("create projects_fts: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS merge_requests_fts USING fts5(
+		title, source_branch, description, tokenize = 'trigram'
+	)`)
+	if err != nil {
+		return fmt.Errorf("create merge_requests_fts: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS issues_fts USING fts5(
+		title, description, tokenize = 'trigram'
+	)`)
+	if err != nil {
+		return fmt.Errorf("create issues_fts: %w", err)
+	}
+
+	stale, _ := getMeta(metaSearchIndexStale)
+
+	for _, t := range []struct{ table, fts, columns string }{
+		{"projects", "projects_fts", "path_with_namespace, name, description"},
+		{"merge_requests", "merge_requests_fts", "title, source_branch, description"},
+		{"issues", "issues_fts", "title, description"},
+	} {
+		var rows, indexed int
+		err := db.QueryRow(fmt.Sprintf("SELECT (SELECT COUNT(*) FROM %s), (SELECT COUNT(*) FROM %s)", t.table, t.fts)).Scan(&rows, &indexed)
+		if err != nil {
+			return fmt.Errorf("count %s: %w", t.fts, err)
+		}
+
+		if rows == indexed && stale == "" {
+			continue
+		}
+
+		slog.Info(Name, "search", fmt.Sprintf("rebuilding %s", t.fts))
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM " + t.fts)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (rowid, %s) SELECT id, %s FROM %s", t.fts, t.columns, t.columns, t.table))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("rebuild %s: %w", t.fts, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if stale != "" {
+		if err := setMeta(context.Background(), metaSearchIndexStale, ""); err != nil {
+			return err
+		}
+	}
+
+	ftsEnabled = true
+	return nil
+}
+
+func indexProjectsTx(tx *sql.Tx, projects []Project) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	del, err := tx.Prepare("DELETE FROM projects_fts WHERE rowid = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	ins, err := tx.Prepare("INSERT INTO projects_fts (rowid, path_with_namespace, name, description) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, p := range projects {
+		if _, err := del.Exec(p.ID); err != nil {
+			return err
+		}
+		if _, err := ins.Exec(p.ID, p.PathWithNamespace, p.Name, p.Description); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexMergeRequestsTx (re)indexes MRs after upsertMergeRequestsTx.
+func indexMergeRequestsTx(tx *sql.Tx, mrs []MergeRequest) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	del, err := tx.Prepare("DELETE FROM merge_requests_fts WHERE rowid = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	ins, err := tx.Prepare("INSERT INTO merge_requests_fts (rowid, title, source_branch, description) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, mr := range mrs {
+		if _, err := del.Exec(mr.ID); err != nil {
+			return err
+		}
+		if _, err := ins.Exec(mr.ID, mr.Title, mr.SourceBranch, mr.Description); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexIssuesTx (re)indexes issues after upsertIssuesTx.
+func indexIssuesTx(tx *sql.Tx, issues []Issue) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	del, err := tx.Prepare("DELETE FROM issues_fts WHERE rowid = ?")
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+
+	ins, err := tx.Prepare("INSERT INTO issues_fts (rowid, title, description) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, issue := range issues {
+		if _, err := del.Exec(issue.ID); err != nil {
+			return err
+		}
+		if _, err := ins.Exec(issue.ID, issue.Title, issue.Description); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneProjectIndexTx drops index entries for projects no longer cached.
+func pruneProjectIndexTx(tx *sql.Tx) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM projects_fts WHERE rowid NOT IN (SELECT id FROM projects)")
+	return err
+}
+
+// pruneMergeRequestIndexTx drops index entries for MRs no longer cached.
+func pruneMergeRequestIndexTx(tx *sql.Tx) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM merge_requests_fts WHERE rowid NOT IN (SELECT id FROM merge_requests)")
+	return err
+}
+
+// pruneIssueIndexTx drops index entries for issues no longer cached.
+func pruneIssueIndexTx(tx *sql.Tx) error {
+	if !ftsEnabled {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM issues_fts WHERE rowid NOT IN (SELECT id FROM issues)")
+	return err
+}
+
+// matchWord returns a WHERE clause restricting table rows to those containing
+// word. The trigram index needs at least three characters, so shorter words
+// and builds without FTS5 use LIKE on the given columns instead, which should
+// be the columns of the FTS table so results don't depend on the build.
+func matchWord(ftsTable string, likeColumns []string, word string) (string, []any) {
+	if ftsEnabled && len([]rune(word)) >= 3 {
+		phrase := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		return "id IN (SELECT rowid FROM " + ftsTable + " WHERE " + ftsTable + " MATCH ?)", []any{phrase}
+	}
+
+	like := "%" + word + "%"
+	clauses := make([]string, len(likeColumns))
+	args := make([]any, len(likeColumns))
+	for i, c := range likeColumns {
+		clauses[i] = c + " LIKE ?"
+		args[i] = like
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
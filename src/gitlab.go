@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +29,9 @@ type Project struct {
 	Description       string    `json:"description"`
 	WebURL            string    `json:"web_url"`
 	Namespace         Namespace `json:"namespace"`
+	DefaultBranch     string    `json:"default_branch"`
+	Topics            []string  `json:"topics"`
+	ReadmeURL         string    `json:"readme_url"`
 	LastActivityAt    time.Time `json:"last_activity_at"`
 }
 
@@ -31,9 +43,27 @@ type MRReferences struct {
 	Full string `json:"full"`
 }
 
+// MRApprovals is the approval state of an MR. It comes from a separate
+// endpoint, so MergeRequest leaves it out of its JSON.
+type MRApprovals struct {
+	ApprovalsLeft int          `json:"approvals_left"`
+	ApprovedBy    []MRApproval `json:"approved_by"`
+}
+
+// MRPipeline is only included when fetching a single MR. Synced MRs get their
+// status from syncPipelines instead.
+type MRPipeline struct {
+	Status string `json:"status"`
+}
+
+type MRApproval struct {
+	User MRAuthor `json:"user"`
+}
+
 type MergeRequest struct {
 	ID           int64        `json:"id"`
 	IID          int64        `json:"iid"`
+	ProjectID    int64        `json:"project_id"`
 	Title        string       `json:"title"`
 	Description  string       `json:"description"`
 	WebURL       string       `json:"web_url"`
@@ -41,8 +71,52 @@ type MergeRequest struct {
 	SourceBranch string       `json:"source_branch"`
 	TargetBranch string       `json:"target_branch"`
 	Author       MRAuthor     `json:"author"`
+	Reviewers    []MRAuthor   `json:"reviewers"`
 	References   MRReferences `json:"references"`
+	Approvals    MRApprovals  `json:"-"`
+	HeadPipeline MRPipeline   `json:"head_pipeline"`
+	Draft        bool         `json:"draft"`
+	Labels       []string     `json:"labels"`
 	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+type Issue struct {
+	ID          int64        `json:"id"`
+	IID         int64        `json:"iid"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	WebURL      string       `json:"web_url"`
+	State       string       `json:"state"`
+	Author      MRAuthor     `json:"author"`
+	References  MRReferences `json:"references"`
+	Labels      []string     `json:"labels"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+type TodoProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+// TodoTarget holds the fields shared by every to-do target type. Commits
+// have a string id, so the id is deliberately left out.
+type TodoTarget struct {
+	IID        int64        `json:"iid"`
+	Title      string       `json:"title"`
+	References MRReferences `json:"references"`
+}
+
+type Todo struct {
+	ID         int64       `json:"id"`
+	ActionName string      `json:"action_name"`
+	TargetType string      `json:"target_type"`
+	TargetURL  string      `json:"target_url"`
+	Body       string      `json:"body"`
+	Project    TodoProject `json:"project"`
+	Author     MRAuthor    `json:"author"`
+	Target     TodoTarget  `json:"target"`
+	CreatedAt  time.Time   `json:"created_at"`
 }
 
 type GitLabUser struct {
@@ -50,41 +124,224 @@ type GitLabUser struct {
 	Username string `json:"username"`
 }
 
+const (
+	perPage        = 100
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+)
+
 type gitlabClient struct {
-	baseURL    string
-	pat        string
-	httpClient *http.Client
+	baseURL     string
+	pat         string
+	httpClient  *http.Client
+	maxRetries  int
+	retryBase   time.Duration
+	concurrency int
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+// pageCounterKey is the context key of the counter getJSON adds to, so that
+// only the pages fetched by a sync count towards its progress.
+type pageCounterKey struct{}
+
+// countPages returns a ctx under which getJSON adds every page it fetches
+// to n.
+func countPages(ctx context.Context, n *atomic.Int64) context.Context {
+	return context.WithValue(ctx, pageCounterKey{}, n)
 }
 
-func newGitLabClient(baseURL, pat string) *gitlabClient {
+func newGitLabClient(baseURL, pat string, maxRetries, concurrency int) *gitlabClient {
 	return &gitlabClient{
 		baseURL: baseURL,
 		pat:     pat,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		maxRetries:  maxRetries,
+		retryBase:   retryBaseDelay,
+		concurrency: concurrency,
 	}
 }
 
-func (c *gitlabClient) request(endpoint string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", c.baseURL+endpoint, nil)
+// request performs a GET against the API.
+func (c *gitlabClient) request(ctx context.Context, endpoint string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, endpoint, nil)
+}
+
+// do performs a request against the API, sending body as JSON unless it is
+// nil. 429s are retried with jittered exponential backoff, honouring
+// Retry-After when GitLab sends it, and so are network errors and 5xx
+// responses of idempotent requests. A POST that failed that way may have
+// taken effect, so it isn't repeated. When the rate limit is exhausted
+// (RateLimit-Remaining: 0) further requests wait until RateLimit-Reset.
+// Cancelling ctx aborts the request and any wait.
+func (c *gitlabClient) do(ctx context.Context, method, endpoint string, body any) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("encode: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
+
+		var reader io.Reader
+		if payload != nil {
+			reader = bytes.NewReader(payload)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+endpoint, reader)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("PRIVATE-TOKEN", c.pat)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		}
+		if err == nil {
+			c.trackRateLimit(resp.Header)
+
+			if !retryableStatus(method, resp.StatusCode) {
+				return resp, nil
+			}
+		}
+
+		if attempt >= c.maxRetries || (err != nil && !idempotent(method)) {
+			return resp, err
+		}
+
+		delay := c.backoff(attempt)
+		if err != nil {
+			slog.Warn(Name, "request", err, "retry", attempt+1, "delay", delay)
+		} else {
+			if d, ok := retryAfter(resp.Header); ok {
+				delay = d
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Warn(Name, "request", fmt.Sprintf("status %d", resp.StatusCode), "retry", attempt+1, "delay", delay)
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryableStatus reports whether a response with status is worth retrying.
+// GitLab doesn't process a request it answers with 429, so that is safe to
+// retry for any method.
+func retryableStatus(method string, status int) bool {
+	return status == http.StatusTooManyRequests || (status >= http.StatusInternalServerError && idempotent(method))
+}
+
+// idempotent reports whether repeating a request with method has the same
+// effect as sending it once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// backoff returns a full-jitter exponential delay for the given attempt.
+func (c *gitlabClient) backoff(attempt int) time.Duration {
+	d := c.retryBase << attempt
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return rand.N(d) + c.retryBase/2
+}
+
+// retryAfter parses the Retry-After header, which GitLab sends either as a
+// number of seconds or as an HTTP date.
+func retryAfter(header http.Header) (time.Duration, bool) {
+	v := header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return min(time.Duration(secs)*time.Second, retryMaxDelay), true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return min(max(time.Until(t), 0), retryMaxDelay), true
+	}
+
+	return 0, false
+}
+
+func (c *gitlabClient) trackRateLimit(header http.Header) {
+	if header.Get("RateLimit-Remaining") != "0" {
+		return
+	}
+
+	reset, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64)
 	if err != nil {
-		return nil, err
+		return
+	}
+
+	until := time.Unix(reset, 0)
+	if time.Until(until) > retryMaxDelay {
+		until = time.Now().Add(retryMaxDelay)
+	}
+
+	c.mu.Lock()
+	if until.After(c.blockedUntil) {
+		c.blockedUntil = until
+	}
+	c.mu.Unlock()
+}
+
+func (c *gitlabClient) waitForRateLimit(ctx context.Context) error {
+	c.mu.Lock()
+	wait := time.Until(c.blockedUntil)
+	c.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
 	}
 
-	req.Header.Set("PRIVATE-TOKEN", c.pat)
-	return c.httpClient.Do(req)
+	slog.Info(Name, "ratelimit", fmt.Sprintf("waiting %v", wait.Round(time.Second)))
+	return sleep(ctx, wait)
+}
+
+// sleep waits for d, returning early with the context's error when ctx is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (c *gitlabClient) getCurrentUser() (*GitLabUser, error) {
-	resp, err := c.request("/api/v4/user")
+func (c *gitlabClient) getCurrentUser(ctx context.Context) (*GitLabUser, error) {
+	resp, err := c.request(ctx, "/api/v4/user")
 	if err != nil {
 		return nil, fmt.Errorf("request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	if err := checkResponse(resp); err != nil {
+		return nil, err
 	}
 
 	var user GitLabUser
@@ -95,39 +352,42 @@ func (c *gitlabClient) getCurrentUser() (*GitLabUser, error) {
 	return &user, nil
 }
 
-func (c *gitlabClient) fetchProjects(maxProjects int, membershipOnly bool) []Project {
-	var all []Project
-	page := 1
-
-	for len(all) < maxProjects {
-		endpoint := fmt.Sprintf("/api/v4/projects?per_page=100&page=%d&order_by=last_activity_at", page)
+// fetchProjects pages through the projects API, limited to projects with
+// activity after since unless it is zero. When GitLab reports
+// X-Total-Pages the remaining pages are fetched concurrently, otherwise it
+// follows X-Next-Page one page at a time. On failure it returns the projects
+// fetched so far along with the error.
+func (c *gitlabClient) fetchProjects(ctx context.Context, maxProjects int, membershipOnly bool, since time.Time) ([]Project, error) {
+	endpoint := func(page int) string {
+		e := fmt.Sprintf("/api/v4/projects?per_page=%d&page=%d&order_by=last_activity_at", perPage, page)
 		if membershipOnly {
-			endpoint += "&membership=true"
+			e += "&membership=true"
 		}
-
-		resp, err := c.request(endpoint)
-		if err != nil {
-			slog.Error(Name, "fetchprojects", err)
-			break
+		if !since.IsZero() {
+			e += "&last_activity_after=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
 		}
+		return e
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			slog.Error(Name, "fetchprojects", fmt.Sprintf("status %d", resp.StatusCode))
-			break
-		}
+	var all []Project
+	resp, err := c.getJSON(ctx, endpoint(1), &all)
+	if err != nil {
+		return nil, fmt.Errorf("projects page 1: %w", err)
+	}
 
-		if err != nil {
-			slog.Error(Name, "fetchprojects", err)
-			break
-		}
+	// GitLab omits X-Total-Pages for very large result sets, in which case
+	// the only option is to walk X-Next-Page.
+	if totalPages, err := strconv.Atoi(resp.Header.Get("X-Total-Pages")); err == nil {
+		lastPage := min(totalPages, (maxProjects+perPage-1)/perPage)
+		rest, err := c.fetchProjectPages(ctx, endpoint, 2, lastPage)
+		return truncateProjects(append(all, rest...), maxProjects), err
+	}
 
+	for page := 2; len(all) < maxProjects && resp.Header.Get("X-Next-Page") != ""; page++ {
 		var projects []Project
-		if err := json.Unmarshal(body, &projects); err != nil {
-			slog.Error(Name, "fetchprojects", err)
-			break
+		resp, err = c.getJSON(ctx, endpoint(page), &projects)
+		if err != nil {
+			return truncateProjects(all, maxProjects), fmt.Errorf("projects page %d: %w", page, err)
 		}
 
 		if len(projects) == 0 {
@@ -135,23 +395,100 @@ func (c *gitlabClient) fetchProjects(maxProjects int, membershipOnly bool) []Pro
 		}
 
 		all = append(all, projects...)
+	}
 
-		nextPage := resp.Header.Get("X-Next-Page")
-		if nextPage == "" {
-			break
+	return truncateProjects(all, maxProjects), nil
+}
+
+// fetchProjectPages fetches pages first..last with at most c.concurrency
+// requests in flight.
+func (c *gitlabClient) fetchProjectPages(ctx context.Context, endpoint func(int) string, first, last int) ([]Project, error) {
+	if last < first {
+		return nil, nil
+	}
+
+	pages := make([][]Project, last-first+1)
+	errs := make([]error, len(pages))
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(c.concurrency, 1), len(pages)) {
+		wg.Go(func() {
+			for i := range work {
+				page := first + i
+				if _, err := c.getJSON(ctx, endpoint(page), &pages[i]); err != nil {
+					errs[i] = fmt.Errorf("projects page %d: %w", page, err)
+				}
+			}
+		})
+	}
+
+	var cancelled error
+dispatch:
+	for i := range pages {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+			break dispatch
 		}
-		page++
+	}
+	close(work)
+	wg.Wait()
+
+	var all []Project
+	for _, p := range pages {
+		all = append(all, p...)
+	}
+
+	return all, errors.Join(append(errs, cancelled)...)
+}
+
+// truncateProjects orders projects by most recent activity and keeps the
+// first maxProjects. Pages fetched concurrently may overlap or shift when
+// activity changes mid-sync, so duplicates are dropped as well.
+func truncateProjects(projects []Project, maxProjects int) []Project {
+	slices.SortStableFunc(projects, func(a, b Project) int {
+		return b.LastActivityAt.Compare(a.LastActivityAt)
+	})
+
+	seen := make(map[int64]bool, len(projects))
+	result := projects[:0]
+	for _, p := range projects {
+		if seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		result = append(result, p)
 	}
 
-	if len(all) > maxProjects {
-		all = all[:maxProjects]
+	if len(result) > maxProjects {
+		result = result[:maxProjects]
 	}
 
-	return all
+	return result
+}
+
+func (c *gitlabClient) fetchMergeRequests(ctx context.Context, endpoint string) ([]MergeRequest, error) {
+	mrs, err := fetchAll[MergeRequest](ctx, c, endpoint)
+	if err != nil {
+		return mrs, fmt.Errorf("merge requests %w", err)
+	}
+	return mrs, nil
 }
 
-func (c *gitlabClient) fetchMergeRequests(endpoint string) []MergeRequest {
-	var all []MergeRequest
+func (c *gitlabClient) fetchIssues(ctx context.Context, endpoint string) ([]Issue, error) {
+	issues, err := fetchAll[Issue](ctx, c, endpoint)
+	if err != nil {
+		return issues, fmt.Errorf("issues %w", err)
+	}
+	return issues, nil
+}
+
+// fetchAll follows X-Next-Page through a list endpoint and returns every
+// item. On failure it returns the items fetched so far along with the error.
+func fetchAll[T any](ctx context.Context, c *gitlabClient, endpoint string) ([]T, error) {
+	var all []T
 	page := 1
 
 	for {
@@ -160,56 +497,283 @@ func (c *gitlabClient) fetchMergeRequests(endpoint string) []MergeRequest {
 			sep = ""
 		}
 
-		url := fmt.Sprintf("%s%sper_page=100&page=%d", endpoint, sep, page)
-		resp, err := c.request(url)
+		url := fmt.Sprintf("%s%sper_page=%d&page=%d", endpoint, sep, perPage, page)
+
+		var items []T
+		resp, err := c.getJSON(ctx, url, &items)
 		if err != nil {
-			slog.Error(Name, "fetchmrs", err)
+			return all, fmt.Errorf("page %d: %w", page, err)
+		}
+
+		if len(items) == 0 {
 			break
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		all = append(all, items...)
 
-		if resp.StatusCode != http.StatusOK {
-			slog.Error(Name, "fetchmrs", fmt.Sprintf("status %d", resp.StatusCode))
+		nextPage := resp.Header.Get("X-Next-Page")
+		if nextPage == "" {
 			break
 		}
+		page++
+	}
 
-		if err != nil {
-			slog.Error(Name, "fetchmrs", err)
-			break
+	return all, nil
+}
+
+// getJSON requests endpoint and decodes a 200 response body into v. The
+// returned response has its body closed; only the headers remain useful.
+func (c *gitlabClient) getJSON(ctx context.Context, endpoint string, v any) (*http.Response, error) {
+	resp, err := c.request(ctx, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	if n, ok := ctx.Value(pageCounterKey{}).(*atomic.Int64); ok {
+		n.Add(1)
+	}
+	return resp, nil
+}
+
+// stateFilter limits an MR or issue listing to open items, or when since is
+// set to items in any state updated after it so that merged and closed ones
+// can be reconciled.
+func stateFilter(since time.Time) string {
+	if since.IsZero() {
+		return "state=opened"
+	}
+	return "state=all&updated_after=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+}
+
+func (c *gitlabClient) fetchAssignedMRs(ctx context.Context, since time.Time) ([]MergeRequest, error) {
+	return c.fetchMergeRequests(ctx, "/api/v4/merge_requests?scope=assigned_to_me&"+stateFilter(since))
+}
+
+func (c *gitlabClient) fetchAuthoredMRs(ctx context.Context, since time.Time) ([]MergeRequest, error) {
+	return c.fetchMergeRequests(ctx, "/api/v4/merge_requests?scope=created_by_me&"+stateFilter(since))
+}
+
+func (c *gitlabClient) fetchReviewingMRs(ctx context.Context, userID int64, since time.Time) ([]MergeRequest, error) {
+	return c.fetchMergeRequests(ctx, fmt.Sprintf("/api/v4/merge_requests?reviewer_id=%d&scope=all&%s", userID, stateFilter(since)))
+}
+
+func (c *gitlabClient) fetchAssignedIssues(ctx context.Context, since time.Time) ([]Issue, error) {
+	return c.fetchIssues(ctx, "/api/v4/issues?scope=assigned_to_me&"+stateFilter(since))
+}
+
+func (c *gitlabClient) fetchAuthoredIssues(ctx context.Context, since time.Time) ([]Issue, error) {
+	return c.fetchIssues(ctx, "/api/v4/issues?scope=created_by_me&"+stateFilter(since))
+}
+
+// fetchMentionedIssues returns issues with a pending to-do for a mention of
+// the current user. The issues API has no mention filter, so this goes
+// through the to-do list instead.
+func (c *gitlabClient) fetchMentionedIssues(ctx context.Context) ([]Issue, error) {
+	type issueTodo struct {
+		ActionName string `json:"action_name"`
+		Target     Issue  `json:"target"`
+	}
+
+	todos, err := fetchAll[issueTodo](ctx, c, "/api/v4/todos?type=Issue&state=pending")
+	if err != nil {
+		return nil, fmt.Errorf("todos %w", err)
+	}
+
+	var issues []Issue
+	seen := make(map[int64]bool)
+	for _, t := range todos {
+		if t.ActionName != "mentioned" && t.ActionName != "directly_addressed" {
+			continue
+		}
+		if seen[t.Target.ID] {
+			continue
 		}
+		seen[t.Target.ID] = true
+		issues = append(issues, t.Target)
+	}
 
-		var mrs []MergeRequest
-		if err := json.Unmarshal(body, &mrs); err != nil {
-			slog.Error(Name, "fetchmrs", err)
-			break
+	return issues, nil
+}
+
+// fetchApprovals fills in the approval state of every open MR in mrs. An MR
+// whose approvals can't be fetched keeps the approvals it already has.
+func (c *gitlabClient) fetchApprovals(ctx context.Context, mrs []MergeRequest) error {
+	return c.forEach(ctx, len(mrs), func(i int) error {
+		mr := &mrs[i]
+		if mr.State != "opened" {
+			return nil
 		}
 
-		if len(mrs) == 0 {
-			break
+		var approvals MRApprovals
+		endpoint := fmt.Sprintf("/api/v4/projects/%d/merge_requests/%d/approvals", mr.ProjectID, mr.IID)
+		if _, err := c.getJSON(ctx, endpoint, &approvals); err != nil {
+			return fmt.Errorf("approvals %s: %w", mr.References.Full, err)
 		}
+		mr.Approvals = approvals
+		return nil
+	})
+}
 
-		all = append(all, mrs...)
+// forEach calls fn for 0..n-1 using up to c.concurrency goroutines and joins
+// the errors.
+func (c *gitlabClient) forEach(ctx context.Context, n int, fn func(i int) error) error {
+	errs := make([]error, n)
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(c.concurrency, 1), n) {
+		wg.Go(func() {
+			for i := range work {
+				errs[i] = fn(i)
+			}
+		})
+	}
 
-		nextPage := resp.Header.Get("X-Next-Page")
-		if nextPage == "" {
-			break
+	// Stop handing out work once ctx is cancelled. fn is expected to fail
+	// fast for anything already running.
+	var cancelled error
+dispatch:
+	for i := range n {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			cancelled = ctx.Err()
+			break dispatch
 		}
-		page++
 	}
+	close(work)
+	wg.Wait()
+
+	return errors.Join(append(errs, cancelled)...)
+}
+
+// fetchLatestPipeline returns the status of the newest pipeline listed by
+// endpoint, or "" when there is none.
+func (c *gitlabClient) fetchLatestPipeline(ctx context.Context, endpoint string) (string, error) {
+	var pipelines []struct {
+		Status string `json:"status"`
+	}
+	if _, err := c.getJSON(ctx, endpoint, &pipelines); err != nil {
+		return "", err
+	}
+	if len(pipelines) == 0 {
+		return "", nil
+	}
+	return pipelines[0].Status, nil
+}
+
+func (c *gitlabClient) fetchMergeRequestPipeline(ctx context.Context, projectID, iid int64) (string, error) {
+	return c.fetchLatestPipeline(ctx, fmt.Sprintf("/api/v4/projects/%d/merge_requests/%d/pipelines?per_page=1", projectID, iid))
+}
+
+func (c *gitlabClient) fetchBranchPipeline(ctx context.Context, projectID int64, ref string) (string, error) {
+	return c.fetchLatestPipeline(ctx, fmt.Sprintf("/api/v4/projects/%d/pipelines?ref=%s&per_page=1", projectID, url.QueryEscape(ref)))
+}
+
+// fetchProject returns a single project by its full path.
+func (c *gitlabClient) fetchProject(ctx context.Context, path string) (Project, error) {
+	var p Project
+	if _, err := c.getJSON(ctx, "/api/v4/projects/"+url.PathEscape(path), &p); err != nil {
+		return p, fmt.Errorf("project %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// fetchMergeRequest returns a single MR by project path and IID.
+func (c *gitlabClient) fetchMergeRequest(ctx context.Context, projectPath string, iid int64) (MergeRequest, error) {
+	var mr MergeRequest
+	endpoint := fmt.Sprintf("/api/v4/projects/%s/merge_requests/%d", url.PathEscape(projectPath), iid)
+	if _, err := c.getJSON(ctx, endpoint, &mr); err != nil {
+		return mr, fmt.Errorf("merge request %s!%d: %w", projectPath, iid, err)
+	}
+	return mr, nil
+}
+
+// fetchIssue returns a single issue by project path and IID.
+func (c *gitlabClient) fetchIssue(ctx context.Context, projectPath string, iid int64) (Issue, error) {
+	var issue Issue
+	endpoint := fmt.Sprintf("/api/v4/projects/%s/issues/%d", url.PathEscape(projectPath), iid)
+	if _, err := c.getJSON(ctx, endpoint, &issue); err != nil {
+		return issue, fmt.Errorf("issue %s#%d: %w", projectPath, iid, err)
+	}
+	return issue, nil
+}
+
+// fetchRawFile returns the contents of a file in a project's repository at
+// ref.
+func (c *gitlabClient) fetchRawFile(ctx context.Context, projectID int64, path, ref string) ([]byte, error) {
+	endpoint := fmt.Sprintf("/api/v4/projects/%d/repository/files/%s/raw?ref=%s",
+		projectID, url.PathEscape(path), url.QueryEscape(ref))
+
+	resp, err := c.request(ctx, endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func (c *gitlabClient) fetchTodos(ctx context.Context) ([]Todo, error) {
+	todos, err := fetchAll[Todo](ctx, c, "/api/v4/todos?state=pending")
+	if err != nil {
+		return todos, fmt.Errorf("todos %w", err)
+	}
+	return todos, nil
+}
 
-	return all
+func (c *gitlabClient) markTodoDone(ctx context.Context, id int64) error {
+	return c.send(ctx, http.MethodPost, fmt.Sprintf("/api/v4/todos/%d/mark_as_done", id), nil, nil)
 }
 
-func (c *gitlabClient) fetchAssignedMRs() []MergeRequest {
-	return c.fetchMergeRequests("/api/v4/merge_requests?scope=assigned_to_me&state=opened")
+func (c *gitlabClient) approveMergeRequest(ctx context.Context, projectID, iid int64) error {
+	return c.send(ctx, http.MethodPost, fmt.Sprintf("/api/v4/projects/%d/merge_requests/%d/approve", projectID, iid), nil, nil)
 }
 
-func (c *gitlabClient) fetchAuthoredMRs() []MergeRequest {
-	return c.fetchMergeRequests("/api/v4/merge_requests?scope=created_by_me&state=opened")
+func (c *gitlabClient) unapproveMergeRequest(ctx context.Context, projectID, iid int64) error {
+	return c.send(ctx, http.MethodPost, fmt.Sprintf("/api/v4/projects/%d/merge_requests/%d/unapprove", projectID, iid), nil, nil)
 }
 
-func (c *gitlabClient) fetchReviewingMRs(userID int64) []MergeRequest {
-	return c.fetchMergeRequests(fmt.Sprintf("/api/v4/merge_requests?reviewer_id=%d&scope=all&state=opened", userID))
+// send performs a write request such as a POST, PUT or DELETE with body
+// encoded as JSON, and decodes the response into v unless it is nil. Any 2xx
+// response is accepted.
+func (c *gitlabClient) send(ctx context.Context, method, endpoint string, body, v any) error {
+	resp, err := c.do(ctx, method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	return nil
 }
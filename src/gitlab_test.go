@@ -0,0 +1,853 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client pointed at srv with retry delays short
+// enough for tests.
+func newTestClient(srv *httptest.Server, maxRetries int) *gitlabClient {
+	c := newGitLabClient(srv.URL, "test-token", maxRetries, 4)
+	c.retryBase = time.Millisecond
+	return c
+}
+
+// useTestClient makes c the provider's client for the rest of the test,
+// signed in as user if it isn't nil.
+func useTestClient(t *testing.T, c *gitlabClient, user *GitLabUser) {
+	apiClient.Store(c)
+	account.Store(user)
+	t.Cleanup(func() {
+		apiClient.Store(nil)
+		account.Store(nil)
+	})
+}
+
+func TestRequest_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"id": 1, "username": "alice"}`)
+	}))
+	defer srv.Close()
+
+	user, err := newTestClient(srv, 5).getCurrentUser(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Username != "alice" {
+		t.Errorf("expected alice, got %q", user.Username)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestRequest_HonoursRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"id": 1, "username": "alice"}`)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	if _, err := newTestClient(srv, 5).getCurrentUser(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for Retry-After, returned after %v", elapsed)
+	}
+}
+
+func TestRequest_GivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := newTestClient(srv, 2).fetchProjects(t.Context(), 100, true, time.Time{})
+	if !errors.Is(err, ErrServerError) {
+		t.Fatalf("expected a server error after exhausting retries, got %v", err)
+	}
+
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestRequest_CancelledDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv, 5)
+	c.retryBase = time.Hour
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.getCurrentUser(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to abort the retries, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to return once cancelled, took %v", elapsed)
+	}
+}
+
+func TestRequest_DoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message": "401 Unauthorized"}`)
+	}))
+	defer srv.Close()
+
+	_, err := newTestClient(srv, 5).getCurrentUser(t.Context())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+}
+
+func TestSend_RetriesPostOnlyWhenRateLimited(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch {
+		case r.URL.Path == "/rate-limited" && n == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/rate-limited":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv, 5)
+
+	// The POST may have taken effect before the gateway failed, so it must
+	// not be sent again.
+	if err := c.send(t.Context(), http.MethodPost, "/approve", nil, nil); !errors.Is(err, ErrServerError) {
+		t.Fatalf("expected ErrServerError, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected a failed POST not to be retried, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	if err := c.send(t.Context(), http.MethodPost, "/rate-limited", nil, nil); err != nil {
+		t.Fatalf("expected a rate-limited POST to be retried, got %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestSend_JSONBodyAndTypedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			if r.Header.Get("Content-Type") != "application/json" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.Copy(w, r.Body)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "403 Forbidden - not allowed"}`)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "404 Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv, 0)
+
+	var got map[string]string
+	if err := c.send(t.Context(), http.MethodPut, "/echo", map[string]string{"state_event": "close"}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["state_event"] != "close" {
+		t.Errorf("expected the body to round-trip, got %v", got)
+	}
+
+	err := c.send(t.Context(), http.MethodPost, "/forbidden", nil, nil)
+	var apiErr *APIError
+	if !errors.Is(err, ErrForbidden) || !errors.As(err, &apiErr) {
+		t.Fatalf("expected a forbidden APIError, got %v", err)
+	}
+	if apiErr.Message != "403 Forbidden - not allowed" {
+		t.Errorf("expected GitLab's message, got %q", apiErr.Message)
+	}
+
+	if err := c.send(t.Context(), http.MethodDelete, "/missing", nil, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetJSON_CountsPagesOfSyncOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 1, "username": "alice"}`)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv, 0)
+
+	var pages atomic.Int64
+	var user GitLabUser
+	if _, err := c.getJSON(countPages(t.Context(), &pages), "/api/v4/user", &user); err != nil {
+		t.Fatal(err)
+	}
+	// Requests outside a sync, such as README lookups, don't count.
+	if _, err := c.getJSON(t.Context(), "/api/v4/user", &user); err != nil {
+		t.Fatal(err)
+	}
+
+	if pages.Load() != 1 {
+		t.Errorf("expected 1 page counted, got %d", pages.Load())
+	}
+}
+
+func TestFetchProjects_ParallelPages(t *testing.T) {
+	const totalPages = 5
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		w.Header().Set("X-Total-Pages", strconv.Itoa(totalPages))
+
+		// Activity decreases with each page and within a page, as GitLab
+		// would return it for order_by=last_activity_at.
+		var projects []string
+		for i := range perPage {
+			id := (page-1)*perPage + i + 1
+			ts := time.Unix(int64(1_000_000-id), 0).UTC().Format(time.RFC3339)
+			projects = append(projects, fmt.Sprintf(`{"id": %d, "last_activity_at": %q}`, id, ts))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(projects, ","))
+	}))
+	defer srv.Close()
+
+	projects, err := newTestClient(srv, 0).fetchProjects(t.Context(), 350, true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 350 {
+		t.Fatalf("expected 350 projects, got %d", len(projects))
+	}
+
+	for i, p := range projects {
+		if p.ID != int64(i+1) {
+			t.Fatalf("expected project %d at position %d, got %d", i+1, i, p.ID)
+		}
+	}
+}
+
+func TestMarkTodoDone_RemovesFromCache(t *testing.T) {
+	setupTestDB(t)
+
+	var marked atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/api/v4/todos/7/mark_as_done" {
+			marked.Store(true)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": 7, "state": "done"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	err := replaceTodos(t.Context(), []Todo{{
+		ID: 7, ActionName: "review_requested", TargetType: "MergeRequest",
+		TargetURL: "https://git.example.com/mr/1", Target: TodoTarget{Title: "bump chart"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results := Query(nil, "todo:chart", false, false, 0); len(results) != 1 {
+		t.Fatalf("expected the todo to be listed, got %d results", len(results))
+	}
+
+	Activate(false, "todo:7", ActionMarkDone, "", "", 0, nil)
+
+	if !marked.Load() {
+		t.Error("expected mark_as_done to be called")
+	}
+
+	if results := Query(nil, "todo:", false, false, 0); len(results) != 0 {
+		t.Errorf("expected the todo to be gone, got %d results", len(results))
+	}
+}
+
+func TestQuery_URLFetchesUncachedMR(t *testing.T) {
+	setupTestDB(t)
+
+	var fetched, missing atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/api/v4/projects/legalcorp%2Flegalcorp-app/merge_requests/42" {
+			fetched.Add(1)
+			fmt.Fprint(w, `{"id": 900, "iid": 42, "title": "feat: contract export", "state": "opened",
+				"web_url": "https://git.example.com/legalcorp/legalcorp-app/-/merge_requests/42",
+				"references": {"full": "legalcorp/legalcorp-app!42"}}`)
+			return
+		}
+		missing.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+	config.GitLabURL = "https://git.example.com"
+
+	// The lookup runs in the background, so the first query returns without
+	// waiting for GitLab.
+	query := "https://git.example.com/legalcorp/legalcorp-app/-/merge_requests/42/diffs"
+	if results := Query(nil, query, false, false, 0); len(results) != 0 {
+		t.Fatalf("expected no results before the MR is fetched, got %v", results)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := getMergeRequestByReference("legalcorp/legalcorp-app", 42); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the MR was never fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for range 2 {
+		results := Query(nil, query, false, false, 0)
+		if len(results) != 1 || results[0].Identifier != "mr:900" {
+			t.Fatalf("expected mr:900, got %v", results)
+		}
+		if results[0].Score != exactMatchScore {
+			t.Errorf("expected exact match score, got %d", results[0].Score)
+		}
+	}
+
+	if fetched.Load() != 1 {
+		t.Errorf("expected the MR to be fetched once and then served from cache, got %d fetches", fetched.Load())
+	}
+
+	// The MR holds no role, so it stays out of the list across all projects.
+	for _, r := range Query(nil, "!", false, false, 0) {
+		if r.Identifier == "mr:900" {
+			t.Error("expected the fetched MR to be left out of the global MR list")
+		}
+	}
+
+	// A reference to an MR that doesn't exist is looked up once, not on
+	// every keystroke.
+	for range 3 {
+		Query(nil, "legalcorp/legalcorp-app!43", false, false, 0)
+		deadline := time.Now().Add(5 * time.Second)
+		for missing.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if missing.Load() != 1 {
+		t.Errorf("expected the missing MR to be looked up once, got %d lookups", missing.Load())
+	}
+}
+
+func TestQuery_ProjectReadmePreview(t *testing.T) {
+	setupTestDB(t)
+	config.ReadmeMaxAge = 60
+
+	var fetched atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/api/v4/projects/8/repository/files/docs%2FREADME.md/raw" && r.URL.Query().Get("ref") == "main" {
+			fetched.Add(1)
+			fmt.Fprint(w, "# Legalcorp app\n\nRun `make dev` to start.")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 8, PathWithNamespace: "legalcorp/legalcorp-app", Name: "legalcorp-app",
+		WebURL: "https://git.example.com/legalcorp/legalcorp-app", DefaultBranch: "main",
+		ReadmeURL: "https://git.example.com/legalcorp/legalcorp-app/-/blob/main/docs/README.md",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preview := func() string {
+		for _, r := range Query(nil, "legalcorp", false, false, 0) {
+			if r.Identifier == "project:8" {
+				return r.Preview
+			}
+		}
+		t.Fatal("expected project:8 in results")
+		return ""
+	}
+
+	if p := preview(); !strings.Contains(p, "Default branch: main") || strings.Contains(p, "make dev") {
+		t.Fatalf("expected a preview without README on first query, got:\n%s", p)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(preview(), "Run `make dev` to start.") {
+		if time.Now().After(deadline) {
+			t.Fatal("README never showed up in the preview")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if fetched.Load() != 1 {
+		t.Errorf("expected the README to be fetched once, got %d", fetched.Load())
+	}
+}
+
+func TestQuery_ProjectReadmeFailureNotRetried(t *testing.T) {
+	setupTestDB(t)
+	config.ReadmeMaxAge = 60
+
+	var fetched atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 9, PathWithNamespace: "legalcorp/legalcorp-docs", Name: "legalcorp-docs",
+		WebURL: "https://git.example.com/legalcorp/legalcorp-docs", DefaultBranch: "main",
+		ReadmeURL: "https://git.example.com/legalcorp/legalcorp-docs/-/blob/main/README.md",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		Query(nil, "legalcorp-docs", false, false, 0)
+		deadline := time.Now().Add(5 * time.Second)
+		for fetched.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if fetched.Load() != 1 {
+		t.Errorf("expected the failed README to be fetched once, got %d", fetched.Load())
+	}
+}
+
+func TestSyncPipelines(t *testing.T) {
+	setupTestDB(t)
+	config.PipelineProjects = 10
+
+	var mrFetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/5/merge_requests/17/pipelines":
+			mrFetches.Add(1)
+			fmt.Fprint(w, `[{"status": "failed"}]`)
+		case "/api/v4/projects/5/pipelines":
+			fmt.Fprint(w, `[{"status": "success"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	err := upsertProjects(t.Context(), []Project{{
+		ID: 5, PathWithNamespace: "researchable/projects/alpha/infrastructure", Name: "infrastructure",
+		WebURL: "https://git.example.com/researchable/projects/alpha/infrastructure", DefaultBranch: "main",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recordProjectOpened("5"); err != nil {
+		t.Fatal(err)
+	}
+
+	mr := MergeRequest{
+		ID: 102, IID: 17, ProjectID: 5, Title: "chore: update helm chart values", State: "opened",
+		References: MRReferences{Full: "researchable/projects/alpha/infrastructure!17"},
+	}
+	if err := upsertMergeRequests(t.Context(), []MergeRequest{mr}, roleAuthored); err != nil {
+		t.Fatal(err)
+	}
+
+	syncPipelines(t.Context())
+
+	// A later MR sync without pipeline data must not clear the status.
+	if err := upsertMergeRequests(t.Context(), []MergeRequest{mr}, roleAuthored); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFuzzyIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "pipeline:failed", false, false, 0)
+	if len(results) != 1 || results[0].Identifier != "mr:102" {
+		t.Fatalf("expected only mr:102, got %v", results)
+	}
+	if !strings.HasSuffix(results[0].Subtext, "pipeline failed") {
+		t.Errorf("expected the pipeline in the subtext, got %q", results[0].Subtext)
+	}
+
+	project, ok := getProjectByPath("researchable/projects/alpha/infrastructure")
+	if !ok || project.PipelineStatus != "success" {
+		t.Errorf("expected the default-branch pipeline to be success, got %q", project.PipelineStatus)
+	}
+
+	// The MR hasn't changed and its pipeline finished, so the next sync
+	// leaves it alone.
+	syncPipelines(t.Context())
+	if mrFetches.Load() != 1 {
+		t.Errorf("expected the finished pipeline to be fetched once, got %d", mrFetches.Load())
+	}
+}
+
+func TestActivate_ApproveMergeRequest(t *testing.T) {
+	setupTestDB(t)
+
+	var approved atomic.Bool
+	var approveCalls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v4/projects/3/merge_requests/621/approve":
+			approveCalls.Add(1)
+			approved.Store(true)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/3/merge_requests/621/approvals":
+			if approved.Load() {
+				fmt.Fprint(w, `{"approvals_left": 0, "approved_by": [{"user": {"username": "alice"}}]}`)
+			} else {
+				fmt.Fprint(w, `{"approvals_left": 1, "approved_by": []}`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), &GitLabUser{ID: 7, Username: "alice"})
+
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 101, IID: 621, ProjectID: 3, Title: "fix: correct permission flags on shared volumes", State: "opened",
+		References: MRReferences{Full: "researchable/general/researchable-infrastructure!621"},
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFuzzyIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := func() []string {
+		results := Query(nil, "res infra!621", false, false, 0)
+		if len(results) == 0 {
+			t.Fatal("expected MR !621")
+		}
+		return results[0].Actions
+	}
+
+	if a := actions(); !slices.Contains(a, ActionApprove) || slices.Contains(a, ActionUnapprove) {
+		t.Fatalf("expected approve to be offered to a reviewer, got %v", a)
+	}
+
+	Activate(false, "mr:101", ActionApprove, "", "", 0, nil)
+
+	if !approved.Load() {
+		t.Fatal("expected the approve endpoint to be called")
+	}
+	if a := actions(); slices.Contains(a, ActionApprove) || !slices.Contains(a, ActionUnapprove) {
+		t.Errorf("expected unapprove after approving, got %v", a)
+	}
+
+	// Approving an MR the cache already shows as approved only refreshes it.
+	Activate(false, "mr:101", ActionApprove, "", "", 0, nil)
+	if approveCalls.Load() != 1 {
+		t.Errorf("expected the approve endpoint to be called once, got %d", approveCalls.Load())
+	}
+}
+
+func TestActivate_ApproveWithRejectedToken(t *testing.T) {
+	setupTestDB(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), &GitLabUser{ID: 7, Username: "alice"})
+	t.Cleanup(func() { setTokenRejected(false) })
+
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 101, IID: 621, ProjectID: 3, Title: "fix: correct permission flags on shared volumes", State: "opened",
+		References: MRReferences{Full: "researchable/general/researchable-infrastructure!621"},
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Activate(false, "mr:101", ActionApprove, "", "", 0, nil)
+
+	if mr, _ := getMergeRequestByID("101"); len(mr.ApprovedBy) != 0 {
+		t.Errorf("expected no approval to be cached, got %v", mr.ApprovedBy)
+	}
+	entries := statusEntries(time.Now())
+	if len(entries) != 1 || entries[0].Identifier != statusToken {
+		t.Errorf("expected the rejected token to be reported, got %v", entries)
+	}
+}
+
+func TestSyncMergeRequests_ApprovalFailureKeepsCached(t *testing.T) {
+	setupTestDB(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/merge_requests":
+			if r.URL.Query().Get("scope") != "assigned_to_me" {
+				fmt.Fprint(w, `[]`)
+				return
+			}
+			fmt.Fprint(w, `[
+				{"id": 101, "iid": 621, "project_id": 3, "state": "opened", "title": "fix: permissions",
+					"references": {"full": "researchable/general/researchable-infrastructure!621"}},
+				{"id": 102, "iid": 17, "project_id": 5, "state": "opened", "title": "chore: helm values",
+					"references": {"full": "researchable/projects/alpha/infrastructure!17"}}]`)
+		case "/api/v4/projects/3/merge_requests/621/approvals":
+			w.WriteHeader(http.StatusForbidden)
+		case "/api/v4/projects/5/merge_requests/17/approvals":
+			fmt.Fprint(w, `{"approvals_left": 0, "approved_by": [{"user": {"username": "bob"}}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), &GitLabUser{ID: 7, Username: "alice"})
+
+	err := setApprovals(t.Context(), 101, MRApprovals{
+		ApprovalsLeft: 1, ApprovedBy: []MRApproval{{User: MRAuthor{Username: "alice"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncMergeRequests(t.Context()); err != nil {
+		t.Fatalf("expected a failed approval lookup not to fail the sync, got %v", err)
+	}
+
+	if mr, _ := getMergeRequestByID("101"); !slices.Equal(mr.ApprovedBy, []string{"alice"}) || mr.ApprovalsLeft != 1 {
+		t.Errorf("expected the cached approvals of !621 to be kept, got %v with %d left", mr.ApprovedBy, mr.ApprovalsLeft)
+	}
+	if mr, _ := getMergeRequestByID("102"); !slices.Equal(mr.ApprovedBy, []string{"bob"}) {
+		t.Errorf("expected the approvals of !17 to be updated, got %v", mr.ApprovedBy)
+	}
+	if _, ok := getMetaTime(metaMRsSyncedAt); !ok {
+		t.Error("expected the MR sync to be recorded")
+	}
+}
+
+func TestSyncAll_UnknownUserKeepsReviews(t *testing.T) {
+	setupTestDB(t)
+
+	var userFails atomic.Bool
+	userFails.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v4/user" && userFails.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/api/v4/user":
+			fmt.Fprint(w, `{"id": 7, "username": "alice"}`)
+		case r.URL.Path == "/api/v4/merge_requests" && r.URL.Query().Get("reviewer_id") == "7":
+			fmt.Fprint(w, `[{"id": 105, "iid": 3, "state": "opened", "title": "chore: pin base image version",
+				"references": {"full": "researchable/general/infrastructure/heroku-vsv-infrastructure!3"}}]`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 105, IID: 3, Title: "chore: pin base image version", State: "opened",
+		References: MRReferences{Full: "researchable/general/infrastructure/heroku-vsv-infrastructure!3"},
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the user the review queue can't be fetched, so a full sync
+	// must leave the cached reviews alone and be tried again.
+	syncAll(t.Context())
+
+	if mr, ok := getMergeRequestByID("105"); !ok || !slices.Contains(mr.Roles, roleReviewing) {
+		t.Errorf("expected the cached review to be kept, got %v", mr.Roles)
+	}
+	if _, ok := getMetaTime(metaMRsFullSyncAt); ok {
+		t.Error("expected the MR sync not to count as a full sync")
+	}
+
+	// The next sync looks the user up again.
+	userFails.Store(false)
+	syncAll(t.Context())
+
+	if user := account.Load(); user == nil || user.Username != "alice" {
+		t.Errorf("expected the user to be looked up, got %v", user)
+	}
+	if mr, ok := getMergeRequestByID("105"); !ok || !slices.Contains(mr.Roles, roleReviewing) {
+		t.Errorf("expected the review to be synced, got %v", mr.Roles)
+	}
+	if _, ok := getMetaTime(metaMRsFullSyncAt); !ok {
+		t.Error("expected a full MR sync to be recorded")
+	}
+}
+
+func TestQuery_WhileSyncLooksUpUser(t *testing.T) {
+	setupTestDB(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 7, "username": "alice"}`)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	// Query runs alongside syncs, which set the user; run with -race.
+	done := make(chan error)
+	go func() { done <- syncUser(t.Context()) }()
+	for range 20 {
+		Query(nil, "!", false, false, 0)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if user := account.Load(); user == nil || user.Username != "alice" {
+		t.Errorf("expected the user to be looked up, got %v", user)
+	}
+}
+
+func TestState_ReportsSyncError(t *testing.T) {
+	setupTestDB(t)
+
+	var rejected atomic.Bool
+	rejected.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case rejected.Load():
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message": "401 Unauthorized"}`)
+		case r.URL.Path == "/api/v4/user":
+			fmt.Fprint(w, `{"id": 7, "username": "alice"}`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	syncAll(t.Context())
+
+	states := State("").States
+	for _, want := range []string{"idle", "error:401 Unauthorized", "summary:never synced — 401 Unauthorized"} {
+		if !slices.Contains(states, want) {
+			t.Errorf("expected state %q, got %v", want, states)
+		}
+	}
+
+	// The error is kept in meta, and cleared by the next successful sync.
+	if msg, _ := getMeta(metaLastError); msg != "401 Unauthorized" {
+		t.Errorf("expected the error to be stored, got %q", msg)
+	}
+
+	rejected.Store(false)
+	syncAll(t.Context())
+
+	states = State("").States
+	if slices.ContainsFunc(states, func(s string) bool { return strings.HasPrefix(s, "error:") }) {
+		t.Errorf("expected the error to be cleared, got %v", states)
+	}
+	if !slices.Contains(states, "summary:last synced just now") {
+		t.Errorf("expected a fresh sync in the summary, got %v", states)
+	}
+}
+
+func TestSyncProjects_TruncatedFullSyncKeepsProjects(t *testing.T) {
+	setupTestDB(t)
+	config.MaxProjects = 3
+
+	// The less active projects have been missing from earlier syncs for long
+	// enough to be removed, were they missing from this one too.
+	if _, err := db.Exec("UPDATE projects SET missing_since = 1 WHERE id > 3"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": 1, "path_with_namespace": "researchable/infrastructure"},
+			{"id": 2, "path_with_namespace": "researchable/sport-data-valley/sdv/sdv-infrastructure"},
+			{"id": 3, "path_with_namespace": "researchable/general/researchable-infrastructure"}]`)
+	}))
+	defer srv.Close()
+
+	useTestClient(t, newTestClient(srv, 0), nil)
+
+	if err := syncProjects(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	projects, err := allProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projects) != 8 {
+		t.Errorf("expected the projects beyond max_projects to be kept, got %d", len(projects))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// fuzzyIndex holds every cached project and MR in memory so that fuzzy
+// matching can consider items the SQL prefilter rejects, e.g. "sdvinfra" for
+// "sdv-infrastructure". It is reloaded from the database after each sync.
+var fuzzyIndex struct {
+	mu       sync.RWMutex
+	projects []dbProject
+	mrs      []dbMergeRequest
+	issues   []dbIssue
+}
+
+func loadFuzzyIndex() error {
+	projects, err := allProjects()
+	if err != nil {
+		return fmt.Errorf("projects: %w", err)
+	}
+
+	mrs, err := allMergeRequests()
+	if err != nil {
+		return fmt.Errorf("merge requests: %w", err)
+	}
+
+	issues, err := allIssues()
+	if err != nil {
+		return fmt.Errorf("issues: %w", err)
+	}
+
+	fuzzyIndex.mu.Lock()
+	fuzzyIndex.projects = projects
+	fuzzyIndex.mrs = mrs
+	fuzzyIndex.issues = issues
+	fuzzyIndex.mu.Unlock()
+
+	slog.Info(Name, "index", fmt.Sprintf("loaded %d projects, %d merge requests, %d issues", len(projects), len(mrs), len(issues)))
+
+	return nil
+}
+
+// indexedProjects returns the cached projects. The slice is replaced, never
+// modified, on reload so callers may use it without holding the lock.
+func indexedProjects() []dbProject {
+	fuzzyIndex.mu.RLock()
+	defer fuzzyIndex.mu.RUnlock()
+	return fuzzyIndex.projects
+}
+
+func indexedMergeRequests() []dbMergeRequest {
+	fuzzyIndex.mu.RLock()
+	defer fuzzyIndex.mu.RUnlock()
+	return fuzzyIndex.mrs
+}
+
+func indexedIssues() []dbIssue {
+	fuzzyIndex.mu.RLock()
+	defer fuzzyIndex.mu.RUnlock()
+	return fuzzyIndex.issues
+}
+
+// projectCandidates returns the projects to score for query: every literal
+// match from the database plus any indexed project the fuzzy matcher accepts.
+func projectCandidates(query string, exact bool) []dbProject {
+	projects := queryProjects(query)
+	if query == "" {
+		return projects
+	}
+
+	seen := make(map[int64]bool, len(projects))
+	for _, p := range projects {
+		seen[p.ID] = true
+	}
+
+	for _, p := range indexedProjects() {
+		if !seen[p.ID] && scoreProject(query, p, exact) > config.MinScore {
+			projects = append(projects, p)
+		}
+	}
+
+	return projects
+}
+
+// mergeRequestCandidates is the MR counterpart of projectCandidates, limited
+// to the given projects (all when nil) and to MRs passing filter.
+func mergeRequestCandidates(projectPaths []string, query string, filter itemFilter, exact bool) []dbMergeRequest {
+	mrs := queryMergeRequestsForProjects(projectPaths, query, filter)
+	if query == "" {
+		return mrs
+	}
+
+	seen := make(map[int64]bool, len(mrs))
+	for _, mr := range mrs {
+		seen[mr.ID] = true
+	}
+
+	for _, mr := range indexedMergeRequests() {
+		if seen[mr.ID] || !inProjects(projectPaths, mr.ProjectPath, mr.Roles) || !filter.matchMergeRequest(mr) {
+			continue
+		}
+		if scoreMergeRequest(query, mr, exact) > config.MinScore {
+			mrs = append(mrs, mr)
+		}
+	}
+
+	return mrs
+}
+
+// issueCandidates is the issue counterpart of mergeRequestCandidates.
+func issueCandidates(projectPaths []string, query string, filter itemFilter, exact bool) []dbIssue {
+	issues := queryIssuesForProjects(projectPaths, query, filter)
+	if query == "" {
+		return issues
+	}
+
+	seen := make(map[int64]bool, len(issues))
+	for _, issue := range issues {
+		seen[issue.ID] = true
+	}
+
+	for _, issue := range indexedIssues() {
+		if seen[issue.ID] || !inProjects(projectPaths, issue.ProjectPath, issue.Roles) || !filter.matchIssue(issue) {
+			continue
+		}
+		if score, _, _ := multiWordFuzzyScore(query, issue.Title, exact); score > config.MinScore {
+			issues = append(issues, issue)
+		}
+	}
+
+	return issues
+}
+
+// inProjects reports whether an item in path holding roles belongs in a list
+// of projectPaths. When projectPaths is nil, the list spans every project and
+// only holds items with a role.
+func inProjects(projectPaths []string, path string, roles []string) bool {
+	if projectPaths == nil {
+		return len(roles) > 0
+	}
+	return slices.Contains(projectPaths, path)
+}
+
+// hasAnyRole reports whether have contains one of want, or want is empty.
+func hasAnyRole(have, want []string) bool {
+	return len(want) == 0 || slices.ContainsFunc(want, func(r string) bool { return slices.Contains(have, r) })
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type dbIssue struct {
+	ID          int64
+	IID         int64
+	Title       string
+	Description string
+	WebURL      string
+	State       string
+	ProjectPath string
+	Author      string
+	Roles       []string
+	Labels      []string
+	CreatedAt   int64
+}
+
+// issueSet is a batch of issues fetched for a single role.
+type issueSet struct {
+	Role   string
+	Issues []Issue
+}
+
+// applyIssues stores every set in a single transaction, the same way
+// applyMergeRequests does for MRs.
+func applyIssues(ctx context.Context, sets []issueSet, prune bool, closedBefore time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if prune {
+		if _, err := tx.Exec("DELETE FROM issue_roles WHERE issue_id IN (SELECT id FROM issues WHERE state = 'opened')"); err != nil {
+			return fmt.Errorf("clear roles: %w", err)
+		}
+	}
+
+	var keep []int64
+	for _, set := range sets {
+		if err := upsertIssuesTx(tx, set.Issues, set.Role); err != nil {
+			return fmt.Errorf("%s: %w", set.Role, err)
+		}
+		for _, issue := range set.Issues {
+			keep = append(keep, issue.ID)
+		}
+	}
+
+	if prune {
+		if err := pruneIssuesTx(tx, keep, closedBefore); err != nil {
+			return fmt.Errorf("prune: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// upsertIssuesTx stores issues along with the given role, if any, keeping
+// closed ones with their new state like upsertMergeRequestsTx.
+func upsertIssuesTx(tx *sql.Tx, issues []Issue, role string) error {
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO issues
+		(id, iid, title, description, web_url, state, project_path, author, labels, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	roleStmt, err := tx.Prepare("INSERT OR IGNORE INTO issue_roles (issue_id, role) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer roleStmt.Close()
+
+	for _, issue := range issues {
+		labels, err := json.Marshal(issue.Labels)
+		if err != nil {
+			return err
+		}
+
+		// Extract project path from full reference like "group/project#123"
+		projectPath := ""
+		if idx := lastIndex(issue.References.Full, '#'); idx > 0 {
+			projectPath = issue.References.Full[:idx]
+		}
+
+		_, err = stmt.Exec(issue.ID, issue.IID, issue.Title, issue.Description, issue.WebURL, issue.State,
+			projectPath, issue.Author.Username, string(labels), issue.CreatedAt.Unix(), issue.UpdatedAt.Unix())
+		if err != nil {
+			return err
+		}
+
+		if role == "" {
+			continue
+		}
+		if _, err = roleStmt.Exec(issue.ID, role); err != nil {
+			return err
+		}
+	}
+
+	if err := indexIssuesTx(tx, issues); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+
+	return nil
+}
+
+// pruneIssuesTx deletes open issues whose id is not in keep, and closed
+// issues last updated before closedBefore.
+func pruneIssuesTx(tx *sql.Tx, keep []int64, closedBefore time.Time) error {
+	ids, err := json.Marshal(keep)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM issues WHERE
+		(state = 'opened' AND id NOT IN (SELECT value FROM json_each(?))) OR
+		(state != 'opened' AND updated_at < ?)`, string(ids), closedBefore.Unix())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM issue_roles WHERE issue_id NOT IN (SELECT id FROM issues)")
+	if err != nil {
+		return err
+	}
+
+	return pruneIssueIndexTx(tx)
+}
+
+const issueColumns = `id, iid, title, description, web_url, state, project_path, author,
+	(SELECT group_concat(role) FROM issue_roles WHERE issue_id = issues.id), labels, created_at`
+
+// queryIssuesForProjects is the issue counterpart of
+// queryMergeRequestsForProjects.
+func queryIssuesForProjects(projectPaths []string, query string, filter itemFilter) []dbIssue {
+	if (filter.draft != nil && *filter.draft) || len(filter.pipelines) > 0 {
+		return nil
+	}
+
+	where := "1"
+	var args []any
+
+	if projectPaths != nil {
+		if len(projectPaths) == 0 {
+			return nil
+		}
+		where = "project_path IN (" + placeholders(len(projectPaths)) + ")"
+		args = appendAll(args, projectPaths)
+	} else {
+		where = "EXISTS (SELECT 1 FROM issue_roles r WHERE r.issue_id = issues.id)"
+	}
+
+	for _, w := range strings.Fields(query) {
+		clause, wordArgs := matchWord("issues_fts", []string{"title", "description"}, w)
+		where += " AND (" + clause + " OR CAST(iid AS TEXT) LIKE ?)"
+		args = append(append(args, wordArgs...), "%"+w+"%")
+	}
+
+	clause, filterArgs := filter.where("issues", "issue_roles", "issue_id")
+	where += clause
+	args = append(args, filterArgs...)
+
+	rows, err := db.Query(`SELECT `+issueColumns+`
+		FROM issues WHERE `+where+`
+		ORDER BY created_at DESC LIMIT 200`, args...)
+	if err != nil {
+		slog.Error(Name, "queryissuesforprojects", err)
+		return nil
+	}
+
+	return scanIssues(rows)
+}
+
+// allIssues returns every cached issue for the in-memory fuzzy index.
+func allIssues() ([]dbIssue, error) {
+	rows, err := db.Query(`SELECT ` + issueColumns + ` FROM issues ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIssues(rows), nil
+}
+
+func scanIssues(rows *sql.Rows) []dbIssue {
+	defer rows.Close()
+
+	var result []dbIssue
+	for rows.Next() {
+		var issue dbIssue
+		var roles sql.NullString
+		var labels string
+		if err := rows.Scan(&issue.ID, &issue.IID, &issue.Title, &issue.Description, &issue.WebURL, &issue.State,
+			&issue.ProjectPath, &issue.Author, &roles, &labels, &issue.CreatedAt); err != nil {
+			continue
+		}
+		issue.Roles = splitRoles(roles.String, issueRoles)
+		json.Unmarshal([]byte(labels), &issue.Labels)
+		result = append(result, issue)
+	}
+
+	return result
+}
+
+func getIssueByReference(projectPath string, iid int64) (dbIssue, bool) {
+	rows, err := db.Query(`SELECT `+issueColumns+` FROM issues WHERE project_path = ? AND iid = ?`, projectPath, iid)
+	if err != nil {
+		slog.Error(Name, "getissuebyreference", err)
+		return dbIssue{}, false
+	}
+
+	issues := scanIssues(rows)
+	if len(issues) == 0 {
+		return dbIssue{}, false
+	}
+	return issues[0], true
+}
+
+func getIssueWebURL(id string) string {
+	var url string
+	err := db.QueryRow("SELECT web_url FROM issues WHERE id = ?", id).Scan(&url)
+	if err != nil {
+		return ""
+	}
+	return url
+}
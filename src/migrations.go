@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+const metaSchemaVersion = "schema_version"
+
+// migrations are applied in order on startup. The schema version stored in
+// meta is the number of migrations applied so far, so new migrations must
+// only ever be appended.
+var migrations = []func(tx *sql.Tx) error{
+	migrateInitialSchema,
+	migrateMergeRequestRoles,
+	migrateProjectMissingSince,
+	migrateIssues,
+	migrateTodos,
+	migrateFilterColumns,
+	migrateMergeRequestDetails,
+	migrateProjectDetails,
+	migratePipelines,
+}
+
+// migrate applies every migration that has not yet been applied, each in its
+// own transaction together with the version bump.
+func migrate() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT
+	)`)
+	if err != nil {
+		return fmt.Errorf("create meta table: %w", err)
+	}
+
+	version := 0
+	if v, ok := getMeta(metaSchemaVersion); ok {
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parse schema version %q: %w", v, err)
+		}
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", metaSchemaVersion, strconv.Itoa(i+1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		slog.Info(Name, "migrate", fmt.Sprintf("applied schema version %d", i+1))
+	}
+
+	return nil
+}
+
+// hasColumn reports whether table has a column with the given name.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// resetSync forgets when resources were last synced, forcing the next sync to
+// be a full one. Migrations use this when the cache has to be rebuilt.
+func resetSync(tx *sql.Tx, keys ...string) error {
+	for _, key := range keys {
+		if _, err := tx.Exec("DELETE FROM meta WHERE key = ?", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateInitialSchema creates the tables as they existed before versioned
+// migrations. Databases from that time already have them.
+func migrateInitialSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS projects (
+		id INTEGER PRIMARY KEY,
+		path_with_namespace TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		web_url TEXT NOT NULL,
+		namespace TEXT DEFAULT '',
+		last_activity_at INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("create projects table: %w", err)
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS merge_requests (
+		id INTEGER PRIMARY KEY,
+		iid INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		web_url TEXT NOT NULL,
+		state TEXT DEFAULT 'opened',
+		source_branch TEXT DEFAULT '',
+		target_branch TEXT DEFAULT '',
+		project_path TEXT DEFAULT '',
+		author TEXT DEFAULT '',
+		role TEXT DEFAULT '',
+		created_at INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("create merge_requests table: %w", err)
+	}
+
+	return nil
+}
+
+// migrateMergeRequestRoles moves the single role column into
+// merge_request_roles so an MR can hold several roles at once, and forces a
+// full MR sync to pick up the roles that were overwritten.
+func migrateMergeRequestRoles(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS merge_request_roles (
+		mr_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		PRIMARY KEY (mr_id, role)
+	)`)
+	if err != nil {
+		return fmt.Errorf("create merge_request_roles table: %w", err)
+	}
+
+	ok, err := hasColumn(tx, "merge_requests", "role")
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO merge_request_roles (mr_id, role)
+			SELECT id, role FROM merge_requests WHERE role != ''`)
+		if err != nil {
+			return fmt.Errorf("backfill roles: %w", err)
+		}
+
+		if _, err = tx.Exec("ALTER TABLE merge_requests DROP COLUMN role"); err != nil {
+			return fmt.Errorf("drop role column: %w", err)
+		}
+	}
+
+	return resetSync(tx, metaMRsSyncedAt, metaMRsFullSyncAt)
+}
+
+// migrateProjectMissingSince tracks since when a project has been absent from
+// full syncs, so it can be removed after a grace period.
+func migrateProjectMissingSince(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE projects ADD COLUMN missing_since INTEGER DEFAULT 0")
+	return err
+}
+
+func migrateIssues(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS issues (
+		id INTEGER PRIMARY KEY,
+		iid INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		web_url TEXT NOT NULL,
+		state TEXT DEFAULT 'opened',
+		project_path TEXT DEFAULT '',
+		author TEXT DEFAULT '',
+		created_at INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("create issues table: %w", err)
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS issue_roles (
+		issue_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		PRIMARY KEY (issue_id, role)
+	)`)
+	if err != nil {
+		return fmt.Errorf("create issue_roles table: %w", err)
+	}
+
+	return nil
+}
+
+func migrateTodos(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS todos (
+		id INTEGER PRIMARY KEY,
+		action_name TEXT DEFAULT '',
+		target_type TEXT DEFAULT '',
+		target_title TEXT DEFAULT '',
+		target_reference TEXT DEFAULT '',
+		target_url TEXT NOT NULL,
+		project_path TEXT DEFAULT '',
+		author TEXT DEFAULT '',
+		body TEXT DEFAULT '',
+		created_at INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("create todos table: %w", err)
+	}
+
+	return nil
+}
+
+// migrateFilterColumns adds the columns used by the draft:, label: and state:
+// filters and forces a full sync to fill them in.
+func migrateFilterColumns(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE merge_requests ADD COLUMN draft INTEGER DEFAULT 0",
+		"ALTER TABLE merge_requests ADD COLUMN labels TEXT DEFAULT '[]'",
+		"ALTER TABLE merge_requests ADD COLUMN updated_at INTEGER DEFAULT 0",
+		"ALTER TABLE issues ADD COLUMN labels TEXT DEFAULT '[]'",
+		"ALTER TABLE issues ADD COLUMN updated_at INTEGER DEFAULT 0",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return resetSync(tx, metaMRsSyncedAt, metaMRsFullSyncAt, metaIssuesSyncedAt, metaIssuesFullSyncAt)
+}
+
+// migrateMergeRequestDetails adds the reviewers and approvals shown in the MR
+// preview, and the project id needed to fetch approvals.
+func migrateMergeRequestDetails(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE merge_requests ADD COLUMN project_id INTEGER DEFAULT 0",
+		"ALTER TABLE merge_requests ADD COLUMN reviewers TEXT DEFAULT '[]'",
+		"ALTER TABLE merge_requests ADD COLUMN approved_by TEXT DEFAULT '[]'",
+		"ALTER TABLE merge_requests ADD COLUMN approvals_left INTEGER DEFAULT 0",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return resetSync(tx, metaMRsSyncedAt, metaMRsFullSyncAt)
+}
+
+// migrateProjectDetails adds the project fields shown in the project preview
+// and a cache for READMEs, which are fetched on demand.
+func migrateProjectDetails(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE projects ADD COLUMN default_branch TEXT DEFAULT ''",
+		"ALTER TABLE projects ADD COLUMN topics TEXT DEFAULT '[]'",
+		"ALTER TABLE projects ADD COLUMN readme_url TEXT DEFAULT ''",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS readmes (
+		project_id INTEGER PRIMARY KEY,
+		content TEXT DEFAULT '',
+		fetched_at INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		return fmt.Errorf("create readmes table: %w", err)
+	}
+
+	return resetSync(tx, metaProjectsSyncedAt, metaProjectsFullSyncAt)
+}
+
+// migratePipelines adds pipeline statuses, and counts how often projects are
+// opened to decide which projects' pipelines to sync.
+func migratePipelines(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE merge_requests ADD COLUMN pipeline_status TEXT DEFAULT ''",
+		"ALTER TABLE projects ADD COLUMN pipeline_status TEXT DEFAULT ''",
+		"ALTER TABLE projects ADD COLUMN opened_count INTEGER DEFAULT 0",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMigrate_LegacySchema(t *testing.T) {
+	var err error
+	db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+	})
+
+	// Schema and data as written by versions without migrations.
+	for _, stmt := range []string{
+		`CREATE TABLE merge_requests (
+			id INTEGER PRIMARY KEY,
+			iid INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			web_url TEXT NOT NULL,
+			state TEXT DEFAULT 'opened',
+			source_branch TEXT DEFAULT '',
+			target_branch TEXT DEFAULT '',
+			project_path TEXT DEFAULT '',
+			author TEXT DEFAULT '',
+			role TEXT DEFAULT '',
+			created_at INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE meta (key TEXT PRIMARY KEY, value TEXT)`,
+		`INSERT INTO merge_requests (id, iid, title, web_url, role) VALUES (1, 1, 'a', 'u', 'reviewing')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var role string
+	if err := db.QueryRow("SELECT role FROM merge_request_roles WHERE mr_id = 1").Scan(&role); err != nil {
+		t.Fatal(err)
+	}
+	if role != roleReviewing {
+		t.Errorf("expected backfilled role %q, got %q", roleReviewing, role)
+	}
+
+	if v, _ := getMeta(metaSchemaVersion); v != strconv.Itoa(len(migrations)) {
+		t.Errorf("expected schema version %d, got %q", len(migrations), v)
+	}
+
+	// Running again must be a no-op.
+	if err := migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// previewTypeText mirrors elephant's internal util.PreviewTypeText.
+const previewTypeText = "text"
+
+// mergeRequestPreview renders the cached details of an MR for the preview
+// pane, with the markdown description below a short summary.
+func mergeRequestPreview(mr dbMergeRequest) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s\n", mr.Title)
+	fmt.Fprintf(&b, "%s!%d · %s", mr.ProjectPath, mr.IID, mr.State)
+	if mr.Draft {
+		b.WriteString(" · draft")
+	}
+	b.WriteString("\n\n")
+
+	fmt.Fprintf(&b, "Branches:  %s → %s\n", mr.SourceBranch, mr.TargetBranch)
+	fmt.Fprintf(&b, "Author:    @%s\n", mr.Author)
+
+	if len(mr.Reviewers) > 0 {
+		reviewers := make([]string, len(mr.Reviewers))
+		for i, r := range mr.Reviewers {
+			reviewers[i] = "@" + r
+			if slices.Contains(mr.ApprovedBy, r) {
+				reviewers[i] += " ✓"
+			}
+		}
+		fmt.Fprintf(&b, "Reviewers: %s\n", strings.Join(reviewers, ", "))
+	}
+
+	fmt.Fprintf(&b, "Approvals: %d given", len(mr.ApprovedBy))
+	if mr.ApprovalsLeft > 0 {
+		fmt.Fprintf(&b, ", %d required", mr.ApprovalsLeft)
+	}
+	b.WriteString("\n")
+
+	if mr.PipelineStatus != "" {
+		fmt.Fprintf(&b, "Pipeline:  %s\n", mr.PipelineStatus)
+	}
+
+	if len(mr.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels:    %s\n", strings.Join(mr.Labels, ", "))
+	}
+
+	if updated := max(mr.UpdatedAt, mr.CreatedAt); updated > 0 {
+		fmt.Fprintf(&b, "Updated:   %s\n", formatTime(time.Unix(updated, 0), time.Now()))
+	}
+
+	if description := strings.TrimSpace(mr.Description); description != "" {
+		fmt.Fprintf(&b, "\n%s\n", description)
+	}
+
+	return b.String()
+}
+
+// projectPreview renders the cached details of a project followed by the
+// start of its README, if it has been fetched.
+func projectPreview(p dbProject, readme string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s\n", p.PathWithNamespace)
+	if p.Description != "" {
+		fmt.Fprintf(&b, "%s\n", p.Description)
+	}
+	b.WriteString("\n")
+
+	if p.DefaultBranch != "" {
+		fmt.Fprintf(&b, "Default branch: %s\n", p.DefaultBranch)
+	}
+	if p.PipelineStatus != "" {
+		fmt.Fprintf(&b, "Pipeline:       %s\n", p.PipelineStatus)
+	}
+	if p.LastActivityAt > 0 {
+		fmt.Fprintf(&b, "Last activity:  %s\n", formatTime(time.Unix(p.LastActivityAt, 0), time.Now()))
+	}
+	if len(p.Topics) > 0 {
+		fmt.Fprintf(&b, "Topics:         %s\n", strings.Join(p.Topics, ", "))
+	}
+
+	if readme != "" {
+		fmt.Fprintf(&b, "\n%s\n", readme)
+	}
+
+	return b.String()
+}
+
+// formatTime formats t as a date followed by how long ago it was.
+func formatTime(t, now time.Time) string {
+	return fmt.Sprintf("%s (%s)", t.Local().Format("2006-01-02 15:04"), ago(now.Sub(t)))
+}
+
+func ago(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%d min ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%d h ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days ago", int(d.Hours()/24))
+	}
+}
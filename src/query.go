@@ -1,10 +1,14 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
 	"net"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abenz1267/elephant/v2/pkg/common"
 	"github.com/abenz1267/elephant/v2/pkg/common/history"
@@ -59,95 +63,383 @@ func scoreProject(query string, p dbProject, exact bool) int32 {
 	return pathScore + nameScore*2
 }
 
-func Query(conn net.Conn, query string, _ bool, exact bool, _ uint8) []*pb.QueryResponse_Item {
-	if db == nil {
+// scoreMergeRequest scores an MR by the better of its title and source
+// branch.
+func scoreMergeRequest(query string, mr dbMergeRequest, exact bool) int32 {
+	titleScore, _, _ := multiWordFuzzyScore(query, mr.Title, exact)
+	branchScore, _, _ := multiWordFuzzyScore(query, mr.SourceBranch, exact)
+	return max(titleScore, branchScore)
+}
+
+// topProjects returns up to n best-matching projects for query as a map from
+// path to weight, where the best match weighs 1 and the others their score
+// relative to it.
+func topProjects(query string, n int, exact bool) map[string]float64 {
+	projects := projectCandidates(query, exact)
+	if len(projects) == 0 {
 		return nil
 	}
 
-	if idx := strings.Index(query, "!"); idx >= 0 {
-		projectQuery := query[:idx]
-		mrQuery := query[idx+1:]
+	n = max(n, 1)
+	weights := make(map[string]float64, n)
 
-		projects := queryProjects(projectQuery)
-		if len(projects) == 0 {
-			return nil
+	scores := make(map[int64]int32, len(projects))
+	for _, p := range projects {
+		scores[p.ID] = scoreProject(query, p, exact)
+	}
+	slices.SortStableFunc(projects, func(a, b dbProject) int {
+		return cmp.Compare(scores[b.ID], scores[a.ID])
+	})
+
+	best := scores[projects[0].ID]
+	for _, p := range projects[:min(n, len(projects))] {
+		weights[p.PathWithNamespace] = 1
+		if best > 0 {
+			weights[p.PathWithNamespace] = float64(max(scores[p.ID], 0)) / float64(best)
 		}
+	}
 
-		// Pick the single best-matching project.
-		best := projects[0]
-		if projectQuery != "" {
-			bestScore := scoreProject(projectQuery, best, exact)
-			for _, p := range projects[1:] {
-				s := scoreProject(projectQuery, p, exact)
-				if s > bestScore {
-					bestScore = s
-					best = p
-				}
-			}
+	return weights
+}
+
+// weightedScore scales the score of an item in project path by that
+// project's weight. Without weights the score is left as is.
+func weightedScore(score int32, weights map[string]float64, path string) int32 {
+	if weights == nil {
+		return score
+	}
+	return int32(float64(score) * weights[path])
+}
+
+// projectPaths returns the paths in weights, or nil for every project.
+func projectPaths(weights map[string]float64) []string {
+	if weights == nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(weights))
+}
+
+// applyHistory adds the usage score for identifier and marks the entry when
+// it has history.
+func applyHistory(entry *pb.QueryResponse_Item, query string) {
+	if !config.History {
+		return
+	}
+
+	usageScore := h.CalcUsageScore(query, entry.Identifier)
+	if usageScore != 0 {
+		entry.State = append(entry.State, history.StateHistory)
+	}
+	entry.Score += usageScore
+}
+
+// exactMatchScore is given to an item named exactly by the query, e.g. by its
+// IID or a pasted URL, so that it outranks any fuzzy match.
+const exactMatchScore = 100_000
+
+// isIID reports whether query is exactly iid.
+func isIID(query string, iid int64) bool {
+	n, err := strconv.ParseInt(query, 10, 64)
+	return err == nil && n == iid
+}
+
+// pipelineIcons replaces the item icon for pipeline statuses worth noticing
+// at a glance.
+var pipelineIcons = map[string]string{
+	"running":  "media-playback-start",
+	"success":  "emblem-ok",
+	"failed":   "dialog-error",
+	"canceled": "process-stop",
+}
+
+// withPipeline shows a pipeline status in the entry's subtext, state and
+// icon.
+func withPipeline(entry *pb.QueryResponse_Item, status string) *pb.QueryResponse_Item {
+	if status == "" {
+		return entry
+	}
+
+	entry.Subtext += " · pipeline " + status
+	entry.State = append(entry.State, "pipeline_"+status)
+	if icon, ok := pipelineIcons[status]; ok {
+		entry.Icon = icon
+	}
+	return entry
+}
+
+func projectEntry(p dbProject, readme string) *pb.QueryResponse_Item {
+	return withPipeline(&pb.QueryResponse_Item{
+		Identifier:  fmt.Sprintf("project:%d", p.ID),
+		Text:        p.Name,
+		Subtext:     p.PathWithNamespace,
+		Icon:        config.Icon,
+		Provider:    Name,
+		Type:        pb.QueryResponse_REGULAR,
+		Actions:     []string{"open", "copy_url"},
+		Preview:     projectPreview(p, readme),
+		PreviewType: previewTypeText,
+	}, p.PipelineStatus)
+}
+
+func mergeRequestEntry(mr dbMergeRequest) *pb.QueryResponse_Item {
+	subtext := fmt.Sprintf("!%d · %s · %s", mr.IID, mr.ProjectPath, strings.Join(mr.Roles, ", "))
+	if mr.State != "opened" {
+		subtext += " · " + mr.State
+	}
+
+	actions := []string{"open", "copy_url"}
+	if user := account.Load(); mr.State == "opened" && user != nil {
+		switch {
+		case slices.Contains(mr.ApprovedBy, user.Username):
+			actions = append(actions, "unapprove")
+		case slices.Contains(mr.Roles, roleReviewing):
+			actions = append(actions, "approve")
 		}
-		paths := []string{best.PathWithNamespace}
-
-		mrs := queryMergeRequestsForProjects(paths, mrQuery)
-		var entries []*pb.QueryResponse_Item
-		for _, mr := range mrs {
-			identifier := fmt.Sprintf("mr:%d", mr.ID)
-			subtext := fmt.Sprintf("!%d · %s · %s", mr.IID, mr.ProjectPath, mr.Role)
-
-			entry := &pb.QueryResponse_Item{
-				Identifier: identifier,
-				Text:       mr.Title,
-				Subtext:    subtext,
-				Icon:       config.Icon,
-				Provider:   Name,
-				Type:       pb.QueryResponse_REGULAR,
-				Actions:    []string{"open", "copy_url"},
-			}
+	}
 
-			if mrQuery != "" {
-				score, pos, start := multiWordFuzzyScore(mrQuery, mr.Title, exact)
-				entry.Score = score
-				entry.Fuzzyinfo = &pb.QueryResponse_Item_FuzzyInfo{
-					Start:     start,
-					Field:     "text",
-					Positions: pos,
-				}
-			}
+	return withPipeline(&pb.QueryResponse_Item{
+		Identifier:  fmt.Sprintf("mr:%d", mr.ID),
+		Text:        mr.Title,
+		Subtext:     subtext,
+		Icon:        config.Icon,
+		Provider:    Name,
+		Type:        pb.QueryResponse_REGULAR,
+		Actions:     actions,
+		Preview:     mergeRequestPreview(mr),
+		PreviewType: previewTypeText,
+	}, mr.PipelineStatus)
+}
 
-			if config.History {
-				usageScore := h.CalcUsageScore(query, identifier)
-				if usageScore != 0 {
-					entry.State = append(entry.State, history.StateHistory)
-				}
-				entry.Score += usageScore
+func issueEntry(issue dbIssue) *pb.QueryResponse_Item {
+	subtext := fmt.Sprintf("#%d · %s · %s", issue.IID, issue.ProjectPath, strings.Join(issue.Roles, ", "))
+	if issue.State != "opened" {
+		subtext += " · " + issue.State
+	}
+
+	return &pb.QueryResponse_Item{
+		Identifier: fmt.Sprintf("issue:%d", issue.ID),
+		Text:       issue.Title,
+		Subtext:    subtext,
+		Icon:       config.Icon,
+		Provider:   Name,
+		Type:       pb.QueryResponse_REGULAR,
+		Actions:    []string{"open", "copy_url"},
+	}
+}
+
+// attentionRank orders MRs by how likely they need action from the user:
+// reviews first, then MRs assigned to them, then their own, with drafts last.
+// attentionOrder does the same in SQL.
+func attentionRank(mr dbMergeRequest) int {
+	switch {
+	case mr.Draft:
+		return 3
+	case slices.Contains(mr.Roles, roleReviewing):
+		return 0
+	case slices.Contains(mr.Roles, roleAssigned):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// sortByAttention sorts mrs by attentionRank and then by most recent update.
+func sortByAttention(mrs []dbMergeRequest) {
+	slices.SortStableFunc(mrs, func(a, b dbMergeRequest) int {
+		return cmp.Or(
+			cmp.Compare(attentionRank(a), attentionRank(b)),
+			cmp.Compare(max(b.UpdatedAt, b.CreatedAt), max(a.UpdatedAt, a.CreatedAt)),
+		)
+	})
+}
+
+// mergeRequestEntries lists MRs matching mrQuery and filter in the projects of
+// weights, scored relative to their project, or in every project when weights
+// is nil.
+func mergeRequestEntries(query string, weights map[string]float64, mrQuery string, filter itemFilter, exact bool) []*pb.QueryResponse_Item {
+	mrs := mergeRequestCandidates(projectPaths(weights), mrQuery, filter, exact)
+	if mrQuery == "" {
+		sortByAttention(mrs)
+	}
+
+	var entries []*pb.QueryResponse_Item
+	for k, mr := range mrs {
+		entry := mergeRequestEntry(mr)
+		entry.Score = int32(1000 - k)
+
+		if isIID(mrQuery, mr.IID) {
+			entry.Score = exactMatchScore
+		} else if mrQuery != "" {
+			_, pos, start := multiWordFuzzyScore(mrQuery, mr.Title, exact)
+			entry.Score = scoreMergeRequest(mrQuery, mr, exact)
+			entry.Fuzzyinfo = &pb.QueryResponse_Item_FuzzyInfo{
+				Start:     start,
+				Field:     "text",
+				Positions: pos,
 			}
+		}
+
+		entry.Score = weightedScore(entry.Score, weights, mr.ProjectPath)
+		applyHistory(entry, query)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
 
-			entries = append(entries, entry)
+func issueEntries(query string, weights map[string]float64, issueQuery string, filter itemFilter, exact bool) []*pb.QueryResponse_Item {
+	issues := issueCandidates(projectPaths(weights), issueQuery, filter, exact)
+	var entries []*pb.QueryResponse_Item
+	for k, issue := range issues {
+		entry := issueEntry(issue)
+		entry.Score = int32(1000 - k)
+
+		if isIID(issueQuery, issue.IID) {
+			entry.Score = exactMatchScore
+		} else if issueQuery != "" {
+			score, pos, start := multiWordFuzzyScore(issueQuery, issue.Title, exact)
+			entry.Score = score
+			entry.Fuzzyinfo = &pb.QueryResponse_Item_FuzzyInfo{
+				Start:     start,
+				Field:     "text",
+				Positions: pos,
+			}
 		}
 
-		return entries
+		entry.Score = weightedScore(entry.Score, weights, issue.ProjectPath)
+		applyHistory(entry, query)
+		entries = append(entries, entry)
 	}
 
+	return entries
+}
+
+// todoPrefix switches Query to the GitLab to-do list.
+const todoPrefix = "todo:"
+
+func todoEntries(query string, todoQuery string, exact bool) []*pb.QueryResponse_Item {
 	var entries []*pb.QueryResponse_Item
+	for k, t := range queryTodos() {
+		identifier := fmt.Sprintf("todo:%d", t.ID)
+
+		reference := t.TargetReference
+		if reference == "" {
+			reference = t.ProjectPath
+		}
+		subtext := fmt.Sprintf("%s · %s · %s", strings.ReplaceAll(t.ActionName, "_", " "), reference, t.Author)
 
-	projects := queryProjects(query)
-	for k, p := range projects {
-		identifier := fmt.Sprintf("project:%d", p.ID)
 		entry := &pb.QueryResponse_Item{
 			Identifier: identifier,
-			Text:       p.Name,
-			Subtext:    p.PathWithNamespace,
+			Text:       t.TargetTitle,
+			Subtext:    subtext,
 			Icon:       config.Icon,
 			Provider:   Name,
 			Type:       pb.QueryResponse_REGULAR,
-			Actions:    []string{"open", "copy_url"},
+			Actions:    []string{"open", "copy_url", "mark_done"},
 			Score:      int32(1000 - k),
 		}
 
-		if query != "" {
-			entry.Score = scoreProject(query, p, exact)
+		if todoQuery != "" {
+			score, pos, start := multiWordFuzzyScore(todoQuery, t.TargetTitle, exact)
+			refScore, _, _ := multiWordFuzzyScore(todoQuery, reference, exact)
+			if max(score, refScore) <= config.MinScore {
+				continue
+			}
 
-			scoreNs, posNs, startNs := multiWordFuzzyScore(query, p.PathWithNamespace, exact)
-			scoreName, posName, startName := multiWordFuzzyScore(query, p.Name, exact)
+			entry.Score = max(score, refScore)
+			entry.Fuzzyinfo = &pb.QueryResponse_Item_FuzzyInfo{
+				Start:     start,
+				Field:     "text",
+				Positions: pos,
+			}
+		}
+
+		applyHistory(entry, query)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func Query(conn net.Conn, query string, _ bool, exact bool, _ uint8) []*pb.QueryResponse_Item {
+	if db == nil {
+		return nil
+	}
+
+	// Status items explain missing or stale results before anything else.
+	return append(statusEntries(time.Now()), search(query, exact)...)
+}
+
+func search(query string, exact bool) []*pb.QueryResponse_Item {
+	// A pasted URL or a full reference such as "group/project!123" jumps
+	// straight to that item.
+	if ref, ok := parseReference(strings.TrimSpace(query)); ok {
+		if entry := referenceEntry(ref); entry != nil {
+			applyHistory(entry, query)
+			return []*pb.QueryResponse_Item{entry}
+		}
+	}
+
+	text, filter := parseFilter(query)
+
+	if rest, ok := strings.CutPrefix(text, todoPrefix); ok {
+		return todoEntries(query, strings.TrimSpace(rest), exact)
+	}
+	if slices.Equal(filter.kinds, []string{kindTodo}) {
+		return todoEntries(query, text, exact)
+	}
+
+	// "project!query" lists MRs and "project#query" issues of the
+	// best-matching projects, or of every project when the project part is
+	// empty.
+	if idx := strings.IndexAny(text, "!#"); idx >= 0 {
+		var weights map[string]float64
+		if projectQuery := strings.TrimSpace(text[:idx]); projectQuery != "" {
+			weights = topProjects(projectQuery, config.DrillDownProjects, exact)
+			if weights == nil {
+				return nil
+			}
+		}
+
+		itemQuery := strings.TrimSpace(text[idx+1:])
+		if text[idx] == '#' {
+			return issueEntries(query, weights, itemQuery, filter, exact)
+		}
+		return mergeRequestEntries(query, weights, itemQuery, filter, exact)
+	}
+
+	// Item filters without a separator search MRs and issues in every
+	// project, e.g. "role:reviewing" for the review queue.
+	if len(filter.kinds) == 0 && filter.hasItemTerms() {
+		filter.kinds = []string{kindMR, kindIssue}
+	}
+
+	var entries []*pb.QueryResponse_Item
+	if slices.Contains(filter.kinds, kindMR) {
+		entries = append(entries, mergeRequestEntries(query, nil, text, filter, exact)...)
+	}
+	if slices.Contains(filter.kinds, kindIssue) {
+		entries = append(entries, issueEntries(query, nil, text, filter, exact)...)
+	}
+	if !filter.wants(kindProject) {
+		return entries
+	}
+
+	projects := projectCandidates(text, exact)
+	ids := make([]int64, len(projects))
+	for i, p := range projects {
+		ids[i] = p.ID
+	}
+	readmes := cachedReadmes(ids)
+	for k, p := range projects {
+		entry := projectEntry(p, readmes[p.ID].Content)
+		entry.Score = int32(1000 - k)
+
+		if text != "" {
+			entry.Score = scoreProject(text, p, exact)
+
+			scoreNs, posNs, startNs := multiWordFuzzyScore(text, p.PathWithNamespace, exact)
+			scoreName, posName, startName := multiWordFuzzyScore(text, p.Name, exact)
 
 			if scoreName >= scoreNs {
 				entry.Fuzzyinfo = &pb.QueryResponse_Item_FuzzyInfo{
@@ -164,16 +456,35 @@ func Query(conn net.Conn, query string, _ bool, exact bool, _ uint8) []*pb.Query
 			}
 		}
 
-		if config.History {
-			usageScore := h.CalcUsageScore(query, identifier)
-			if usageScore != 0 {
-				entry.State = append(entry.State, history.StateHistory)
-			}
-			entry.Score += usageScore
-		}
-
+		applyHistory(entry, query)
 		entries = append(entries, entry)
 	}
 
+	prefetchReadmes(projects, entries[len(entries)-len(projects):], readmes)
+
 	return entries
 }
+
+// readmePrefetch is the number of top-ranked projects whose README is fetched
+// when missing or expired, so that it is there by the next keystroke.
+const readmePrefetch = 3
+
+// prefetchReadmes requests the READMEs of the best-scoring projects. entries
+// holds the entry for each project, in the same order.
+func prefetchReadmes(projects []dbProject, entries []*pb.QueryResponse_Item, readmes map[int64]cachedReadme) {
+	order := make([]int, len(projects))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(entries[b].Score, entries[a].Score)
+	})
+
+	now := time.Now()
+	for _, i := range order[:min(readmePrefetch, len(order))] {
+		r, ok := readmes[projects[i].ID]
+		if readmeExpired(r, ok, now) {
+			requestReadme(projects[i])
+		}
+	}
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -80,35 +86,8 @@ func setupTestDB(t *testing.T) {
 		db = nil
 	})
 
-	// Create tables
-	for _, ddl := range []string{
-		`CREATE TABLE projects (
-			id INTEGER PRIMARY KEY,
-			path_with_namespace TEXT NOT NULL,
-			name TEXT NOT NULL,
-			description TEXT DEFAULT '',
-			web_url TEXT NOT NULL,
-			namespace TEXT DEFAULT '',
-			last_activity_at INTEGER DEFAULT 0
-		)`,
-		`CREATE TABLE merge_requests (
-			id INTEGER PRIMARY KEY,
-			iid INTEGER NOT NULL,
-			title TEXT NOT NULL,
-			description TEXT DEFAULT '',
-			web_url TEXT NOT NULL,
-			state TEXT DEFAULT 'opened',
-			source_branch TEXT DEFAULT '',
-			target_branch TEXT DEFAULT '',
-			project_path TEXT DEFAULT '',
-			author TEXT DEFAULT '',
-			role TEXT DEFAULT '',
-			created_at INTEGER DEFAULT 0
-		)`,
-	} {
-		if _, err := db.Exec(ddl); err != nil {
-			t.Fatal(err)
-		}
+	if err := migrate(); err != nil {
+		t.Fatal(err)
 	}
 
 	// Insert projects — paths mirror real structure, names are last segment.
@@ -150,13 +129,25 @@ func setupTestDB(t *testing.T) {
 		{105, 3, "chore: pin base image version", "researchable/general/infrastructure/heroku-vsv-infrastructure", "chore/pin-image"},
 	}
 	for _, mr := range mrs {
-		_, err := db.Exec(`INSERT INTO merge_requests (id, iid, title, web_url, project_path, source_branch, role, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		_, err := db.Exec(`INSERT INTO merge_requests (id, iid, title, web_url, project_path, source_branch, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
 			mr.id, mr.iid, mr.title, "https://git.example.com/"+mr.projectPath+"/-/merge_requests/"+string(rune(mr.iid+'0')),
-			mr.projectPath, mr.branch, "authored", 1000+mr.id)
+			mr.projectPath, mr.branch, 1000+mr.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO merge_request_roles (mr_id, role) VALUES (?, ?)`, mr.id, "authored")
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
+
+	if err := setupSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadFuzzyIndex(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestQuery_ProjectRanking(t *testing.T) {
@@ -225,6 +216,116 @@ func TestDrillDown_BestProject(t *testing.T) {
 	}
 }
 
+func TestDrillDown_TopProjects(t *testing.T) {
+	setupTestDB(t)
+	config.DrillDownProjects = 5
+
+	// "res infra!" should also list MRs from the other infrastructure
+	// projects, ranked below those of the best match.
+	results := Query(nil, "res infra!", false, false, 0)
+	if len(results) == 0 {
+		t.Fatal("expected MR results from drill-down, got none")
+	}
+
+	projects := map[string]bool{}
+	best := results[0]
+	for _, r := range results {
+		projects[strings.Split(r.Subtext, " · ")[1]] = true
+		if r.Score > best.Score {
+			best = r
+		}
+	}
+
+	if len(projects) < 2 {
+		t.Errorf("expected MRs from several projects, got %v", projects)
+	}
+
+	if !strings.Contains(best.Subtext, "researchable/general/researchable-infrastructure") {
+		t.Errorf("expected an MR of the best-matching project first, got %q", best.Subtext)
+	}
+}
+
+func TestQuery_FullReference(t *testing.T) {
+	setupTestDB(t)
+
+	results := Query(nil, "researchable/projects/alpha/infrastructure!17", false, false, 0)
+	if len(results) != 1 || results[0].Identifier != "mr:102" {
+		t.Fatalf("expected mr:102, got %v", results)
+	}
+
+	// A bare IID after a project part ranks the exact MR first.
+	results = Query(nil, "res infra!620", false, false, 0)
+	if len(results) == 0 || results[0].Score < exactMatchScore/2 {
+		t.Errorf("expected an exact IID match with a high score, got %v", results)
+	}
+}
+
+func TestQuery_GlobalMergeRequests(t *testing.T) {
+	setupTestDB(t)
+
+	// Under review in one project and a draft in another; the review
+	// should come first and the draft last.
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 105, IID: 3, Title: "chore: pin base image version", State: "opened",
+		References: MRReferences{Full: "researchable/general/infrastructure/heroku-vsv-infrastructure!3"},
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 102, IID: 17, Title: "chore: update helm chart values", State: "opened", Draft: true,
+		References: MRReferences{Full: "researchable/projects/alpha/infrastructure!17"},
+	}}, roleAuthored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "!", false, false, 0)
+	if len(results) != 6 {
+		t.Fatalf("expected all 6 MRs, got %d", len(results))
+	}
+	if results[0].Identifier != "mr:105" || results[len(results)-1].Identifier != "mr:102" {
+		t.Errorf("expected review first and draft last, got %s ... %s", results[0].Identifier, results[len(results)-1].Identifier)
+	}
+
+	// Text after an empty project part searches titles in every project.
+	results = Query(nil, "!snapshots", false, false, 0)
+	if len(results) == 0 || results[0].Identifier != "mr:104" {
+		t.Errorf("expected mr:104 for !snapshots, got %v", results)
+	}
+}
+
+func TestQuery_GlobalMergeRequestsBeyondLimit(t *testing.T) {
+	setupTestDB(t)
+
+	// More recent MRs than fit in the list should not push out an old MR
+	// that is waiting for a review.
+	var authored []MergeRequest
+	for i := range 250 {
+		authored = append(authored, MergeRequest{
+			ID: int64(1000 + i), IID: int64(1000 + i), Title: "feat: recent change", State: "opened",
+			References: MRReferences{Full: fmt.Sprintf("researchable/infrastructure!%d", 1000+i)},
+			CreatedAt:  time.Date(2026, 1, 1, 0, i, 0, 0, time.UTC),
+		})
+	}
+	if err := upsertMergeRequests(t.Context(), authored, roleAuthored); err != nil {
+		t.Fatal(err)
+	}
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 2000, IID: 1, Title: "fix: old review", State: "opened",
+		References: MRReferences{Full: "researchable/infrastructure!1"},
+		CreatedAt:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "!", false, false, 0)
+	if len(results) == 0 || results[0].Identifier != "mr:2000" {
+		t.Errorf("expected the old review first, got %v", results[:min(len(results), 1)])
+	}
+}
+
 func TestDrillDown_WithMRQuery(t *testing.T) {
 	setupTestDB(t)
 
@@ -255,3 +356,210 @@ func TestDrillDown_ByIID(t *testing.T) {
 		t.Errorf("expected MR !620, got %q", results[0].Subtext)
 	}
 }
+
+func TestDrillDown_RoleFilter(t *testing.T) {
+	setupTestDB(t)
+
+	// MR !621 is both authored and under review; role:reviewing should
+	// filter to it and the subtext should list both.
+	err := upsertMergeRequests(t.Context(), []MergeRequest{{
+		ID: 101, IID: 621, Title: "fix: correct permission flags on shared volumes", State: "opened",
+		WebURL:     "https://git.example.com/researchable/general/researchable-infrastructure/-/merge_requests/621",
+		References: MRReferences{Full: "researchable/general/researchable-infrastructure!621"},
+	}}, roleReviewing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "res infra!role:reviewing", false, false, 0)
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+
+	if !strings.HasSuffix(results[0].Subtext, "authored, reviewing") {
+		t.Errorf("expected both roles in subtext, got %q", results[0].Subtext)
+	}
+}
+
+func TestQuery_FuzzyWithoutSubstring(t *testing.T) {
+	setupTestDB(t)
+
+	// "sdvinfra" is not a substring of any path, so only the in-memory
+	// fuzzy index can find sdv-infrastructure.
+	results := Query(nil, "sdvinfra", false, false, 0)
+
+	if len(results) == 0 {
+		t.Fatal("expected fuzzy project results, got none")
+	}
+
+	best := results[0]
+	for _, r := range results[1:] {
+		if r.Score > best.Score {
+			best = r
+		}
+	}
+
+	if best.Text != "sdv-infrastructure" {
+		t.Errorf("expected sdv-infrastructure as best match, got %q", best.Text)
+	}
+}
+
+func TestDrillDown_Issues(t *testing.T) {
+	setupTestDB(t)
+
+	err := applyIssues(t.Context(), []issueSet{{Role: roleAssigned, Issues: []Issue{
+		{ID: 300, IID: 12, Title: "flaky backup job", State: "opened", WebURL: "https://git.example.com/i/12",
+			References: MRReferences{Full: "researchable/general/researchable-infrastructure#12"}},
+		{ID: 301, IID: 3, Title: "flaky deploys", State: "opened", WebURL: "https://git.example.com/i/3",
+			References: MRReferences{Full: "legalcorp/legalcorp-app#3"}},
+	}}}, false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "res infra#flaky", false, false, 0)
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+
+	if results[0].Identifier != "issue:300" {
+		t.Errorf("expected issue:300, got %q", results[0].Identifier)
+	}
+
+	if url := resolveURL(results[0].Identifier); url != "https://git.example.com/i/12" {
+		t.Errorf("expected issue url to resolve, got %q", url)
+	}
+}
+
+func TestQuery_Filters(t *testing.T) {
+	setupTestDB(t)
+
+	err := upsertMergeRequests(t.Context(), []MergeRequest{
+		{ID: 103, IID: 27, Title: "feat: add integration test suite", State: "merged",
+			Author: MRAuthor{Username: "alice"}, Labels: []string{"backend"},
+			References: MRReferences{Full: "researchable/projects/beta/infrastructure!27"}},
+		{ID: 104, IID: 38, Title: "feat: enable daily snapshots", State: "opened", Draft: true,
+			Author: MRAuthor{Username: "alice"}, Labels: []string{"backend", "ops"},
+			References: MRReferences{Full: "researchable/projects/beta/infrastructure!38"}},
+	}, roleAuthored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFuzzyIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"author:alice", []string{"mr:104"}},
+		{"author:alice state:merged", []string{"mr:103"}},
+		{"is:mr label:backend state:all", []string{"mr:103", "mr:104"}},
+		{"label:backend label:ops", []string{"mr:104"}},
+		{"beta!draft:false", nil},
+		{"beta! draft:true snapshots", []string{"mr:104"}},
+		{"is:mr state:merged integration", []string{"mr:103"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, r := range Query(nil, tt.query, false, false, 0) {
+			got = append(got, r.Identifier)
+		}
+		slices.Sort(got)
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestMergeRequestPreview(t *testing.T) {
+	setupTestDB(t)
+
+	mr := MergeRequest{
+		ID: 100, IID: 620, Title: "fix: bump retry timeout for background jobs", State: "opened",
+		Description: "Jobs time out on **large** imports.", SourceBranch: "fix/retry-timeout", TargetBranch: "main",
+		Author: MRAuthor{Username: "alice"}, Reviewers: []MRAuthor{{Username: "bob"}, {Username: "carol"}},
+		Labels:     []string{"backend"},
+		References: MRReferences{Full: "researchable/general/researchable-infrastructure!620"},
+	}
+	mr.Approvals = MRApprovals{ApprovalsLeft: 1, ApprovedBy: []MRApproval{{User: MRAuthor{Username: "bob"}}}}
+
+	if err := upsertMergeRequests(t.Context(), []MergeRequest{mr}, roleAuthored); err != nil {
+		t.Fatal(err)
+	}
+
+	results := Query(nil, "res infra!620", false, false, 0)
+	if len(results) == 0 {
+		t.Fatal("expected MR !620")
+	}
+
+	preview := results[0].Preview
+	for _, want := range []string{
+		"fix/retry-timeout → main", "@alice", "@bob ✓, @carol", "1 given, 1 required", "backend",
+		"Jobs time out on **large** imports.",
+	} {
+		if !strings.Contains(preview, want) {
+			t.Errorf("expected %q in preview:\n%s", want, preview)
+		}
+	}
+}
+
+func TestQuery_StatusItems(t *testing.T) {
+	setupTestDB(t)
+	config.GitLabURL = "https://git.example.com/"
+	t.Cleanup(func() {
+		setTokenMissing(false)
+		recordSyncResult(t.Context(), time.Now(), nil)
+	})
+
+	// A rejected token comes first and links to the token settings.
+	setTokenRejected(true)
+	results := Query(nil, "infra", false, false, 0)
+	if len(results) < 2 || results[0].Identifier != statusToken {
+		t.Fatalf("expected the token status item before the results, got %d results", len(results))
+	}
+	if !strings.Contains(results[0].Text, "expired") {
+		t.Errorf("expected an expired token message, got %q", results[0].Text)
+	}
+	if got := resolveURL(statusToken); got != "https://git.example.com/-/user_settings/personal_access_tokens" {
+		t.Errorf("unexpected token settings URL %q", got)
+	}
+
+	// Failing to reach GitLab shows how old the cache is instead.
+	if err := setMetaTime(t.Context(), metaProjectsSyncedAt, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	offline := fmt.Errorf("projects: %w", &url.Error{Op: "Get", URL: "https://git.example.com/api/v4/projects", Err: errors.New("connection refused")})
+	if err := recordSyncResult(t.Context(), time.Now(), offline); err != nil {
+		t.Fatal(err)
+	}
+
+	results = Query(nil, "infra", false, false, 0)
+	if results[0].Identifier != statusOffline || !strings.Contains(results[0].Text, "2 h ago") {
+		t.Errorf("expected an offline item with the cache age, got %q", results[0].Text)
+	}
+
+	// GitLab failing a request isn't the same as being unreachable.
+	serverErr := fmt.Errorf("approvals: %w", &APIError{Method: "GET", Endpoint: "/approvals", Status: http.StatusBadGateway})
+	if err := recordSyncResult(t.Context(), time.Now(), serverErr); err != nil {
+		t.Fatal(err)
+	}
+	results = Query(nil, "infra", false, false, 0)
+	if len(results) > 0 && strings.HasPrefix(results[0].Identifier, statusPrefix) {
+		t.Errorf("expected no status item after a server error, got %q", results[0].Text)
+	}
+
+	// A successful sync clears it.
+	if err := recordSyncResult(t.Context(), time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	results = Query(nil, "infra", false, false, 0)
+	if len(results) > 0 && strings.HasPrefix(results[0].Identifier, "status:") {
+		t.Errorf("expected no status item after a successful sync, got %q", results[0].Text)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readmePreviewLines caps how much of a README is cached and previewed.
+const readmePreviewLines = 40
+
+// readmeRetryAfter is how long a failed README fetch is remembered, so that
+// it isn't retried on every keystroke.
+const readmeRetryAfter = time.Minute
+
+// readmeFetches tracks the projects whose README is being fetched, so that
+// repeated queries don't fetch the same README more than once, and when
+// fetching a README last failed.
+var readmeFetches struct {
+	mu       sync.Mutex
+	inFlight map[int64]bool
+	failed   map[int64]time.Time
+}
+
+type cachedReadme struct {
+	Content   string
+	FetchedAt time.Time
+}
+
+// cachedReadmes returns the cached READMEs of projectIDs by project id.
+func cachedReadmes(projectIDs []int64) map[int64]cachedReadme {
+	readmes := make(map[int64]cachedReadme)
+	if len(projectIDs) == 0 {
+		return readmes
+	}
+
+	rows, err := db.Query("SELECT project_id, content, fetched_at FROM readmes WHERE project_id IN ("+
+		placeholders(len(projectIDs))+")", appendAll(nil, projectIDs)...)
+	if err != nil {
+		slog.Error(Name, "cachedreadmes", err)
+		return readmes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, fetchedAt int64
+		var content string
+		if err := rows.Scan(&id, &content, &fetchedAt); err != nil {
+			continue
+		}
+		readmes[id] = cachedReadme{Content: content, FetchedAt: time.Unix(fetchedAt, 0)}
+	}
+
+	return readmes
+}
+
+func setReadme(ctx context.Context, projectID int64, content string, fetchedAt time.Time) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO readmes (project_id, content, fetched_at) VALUES (?, ?, ?)",
+		projectID, content, fetchedAt.Unix())
+	return err
+}
+
+// readmeExpired reports whether r is missing or older than ReadmeMaxAge.
+func readmeExpired(r cachedReadme, ok bool, now time.Time) bool {
+	return !ok || now.Sub(r.FetchedAt) >= time.Duration(config.ReadmeMaxAge)*time.Minute
+}
+
+// readmePath returns the repository path of the README that readme_url
+// points at, e.g. "docs/README.md" for ".../-/blob/main/docs/README.md".
+func readmePath(p dbProject) (string, bool) {
+	_, path, ok := strings.Cut(p.ReadmeURL, "/-/blob/"+p.DefaultBranch+"/")
+	return path, ok && path != ""
+}
+
+// requestReadme fetches the README of p in the background unless a fetch is
+// already running or failed within readmeRetryAfter. A project without a
+// README is cached as empty so it isn't asked for again until it expires.
+func requestReadme(p dbProject) {
+	client := apiClient.Load()
+	if client == nil {
+		return
+	}
+
+	now := time.Now()
+
+	readmeFetches.mu.Lock()
+	if readmeFetches.inFlight == nil {
+		readmeFetches.inFlight = make(map[int64]bool)
+		readmeFetches.failed = make(map[int64]time.Time)
+	}
+	if readmeFetches.inFlight[p.ID] || now.Sub(readmeFetches.failed[p.ID]) < readmeRetryAfter {
+		readmeFetches.mu.Unlock()
+		return
+	}
+	readmeFetches.inFlight[p.ID] = true
+	readmeFetches.mu.Unlock()
+
+	go func() {
+		ok := fetchReadme(client, p)
+
+		readmeFetches.mu.Lock()
+		defer readmeFetches.mu.Unlock()
+
+		delete(readmeFetches.inFlight, p.ID)
+		for id, at := range readmeFetches.failed {
+			if time.Since(at) >= readmeRetryAfter {
+				delete(readmeFetches.failed, id)
+			}
+		}
+		if !ok {
+			readmeFetches.failed[p.ID] = time.Now()
+		}
+	}()
+}
+
+// fetchReadme fetches the README of p from GitLab and caches it.
+func fetchReadme(client *gitlabClient, p dbProject) bool {
+	var content string
+	if path, ok := readmePath(p); ok {
+		// A README missing from the default branch is cached as empty, like
+		// a project without one.
+		data, err := client.fetchRawFile(context.Background(), p.ID, path, p.DefaultBranch)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			slog.Error(Name, "readme", fmt.Sprintf("%s: %v", p.PathWithNamespace, err))
+			return false
+		}
+		content = truncateLines(string(data), readmePreviewLines)
+	}
+
+	if err := setReadme(context.Background(), p.ID, content, time.Now()); err != nil {
+		slog.Error(Name, "readme", err)
+		return false
+	}
+	return true
+}
+
+// truncateLines returns the first n lines of s, marking the cut.
+func truncateLines(s string, n int) string {
+	lines := strings.SplitN(s, "\n", n+1)
+	if len(lines) <= n {
+		return strings.TrimSpace(s)
+	}
+	return strings.TrimSpace(strings.Join(lines[:n], "\n")) + "\n…"
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abenz1267/elephant/v2/pkg/pb/pb"
+)
+
+// reference names a single project, MR or issue, as parsed from a full
+// GitLab reference or a pasted URL.
+type reference struct {
+	kind        string
+	projectPath string
+	iid         int64
+}
+
+// fullReference matches "group/project!123" and "group/project#45".
+var fullReference = regexp.MustCompile(`^([\w.-]+(?:/[\w.-]+)+)([!#])(\d+)$`)
+
+// parseReference recognises full references and URLs on the configured
+// GitLab instance.
+func parseReference(query string) (reference, bool) {
+	if m := fullReference.FindStringSubmatch(query); m != nil {
+		iid, err := strconv.ParseInt(m[3], 10, 64)
+		if err != nil {
+			return reference{}, false
+		}
+
+		kind := kindMR
+		if m[2] == "#" {
+			kind = kindIssue
+		}
+		return reference{kind: kind, projectPath: m[1], iid: iid}, true
+	}
+
+	return parseURLReference(query)
+}
+
+// parseURLReference turns a web URL such as
+// "https://gitlab.com/group/project/-/merge_requests/123" into a reference.
+// Any other page below a project refers to the project itself.
+func parseURLReference(raw string) (reference, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return reference{}, false
+	}
+
+	base, err := url.Parse(config.GitLabURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) {
+		return reference{}, false
+	}
+
+	path, ok := strings.CutPrefix(u.Path, strings.TrimSuffix(base.Path, "/")+"/")
+	if !ok {
+		return reference{}, false
+	}
+
+	projectPath, rest, _ := strings.Cut(strings.Trim(path, "/"), "/-/")
+	if !strings.Contains(projectPath, "/") {
+		return reference{}, false
+	}
+
+	ref := reference{kind: kindProject, projectPath: projectPath}
+
+	kind, rest, _ := strings.Cut(rest, "/")
+	iid, _, _ := strings.Cut(rest, "/")
+	n, err := strconv.ParseInt(iid, 10, 64)
+	if err != nil {
+		return ref, true
+	}
+
+	switch kind {
+	case "merge_requests":
+		ref.kind, ref.iid = kindMR, n
+	case "issues", "work_items":
+		ref.kind, ref.iid = kindIssue, n
+	}
+
+	return ref, true
+}
+
+// referenceEntry returns the item ref points at. An item that is not cached
+// yet is looked up in the background, and nil returned until it is.
+func referenceEntry(ref reference) *pb.QueryResponse_Item {
+	var entry *pb.QueryResponse_Item
+
+	switch ref.kind {
+	case kindProject:
+		p, ok := getProjectByPath(ref.projectPath)
+		if !ok {
+			requestReference(ref)
+		} else {
+			r, cached := cachedReadmes([]int64{p.ID})[p.ID]
+			if readmeExpired(r, cached, time.Now()) {
+				requestReadme(p)
+			}
+			entry = projectEntry(p, r.Content)
+		}
+	case kindMR:
+		mr, ok := getMergeRequestByReference(ref.projectPath, ref.iid)
+		if !ok {
+			requestReference(ref)
+		} else {
+			entry = mergeRequestEntry(mr)
+		}
+	case kindIssue:
+		issue, ok := getIssueByReference(ref.projectPath, ref.iid)
+		if !ok {
+			requestReference(ref)
+		} else {
+			entry = issueEntry(issue)
+		}
+	}
+
+	if entry != nil {
+		entry.Score = exactMatchScore
+	}
+
+	return entry
+}
+
+const (
+	// referenceTimeout bounds a background lookup, retries included.
+	referenceTimeout = 10 * time.Second
+
+	// referenceRetryAfter is how long a failed lookup is remembered, so that
+	// a query naming a missing item doesn't ask GitLab on every keystroke.
+	referenceRetryAfter = time.Minute
+)
+
+var referenceFetches struct {
+	mu       sync.Mutex
+	inFlight map[reference]bool
+	failed   map[reference]time.Time
+}
+
+// requestReference looks up ref on GitLab in the background, unless that is
+// already under way or failed within referenceRetryAfter.
+func requestReference(ref reference) {
+	client := apiClient.Load()
+	if client == nil {
+		return
+	}
+
+	now := time.Now()
+
+	referenceFetches.mu.Lock()
+	if referenceFetches.inFlight == nil {
+		referenceFetches.inFlight = make(map[reference]bool)
+		referenceFetches.failed = make(map[reference]time.Time)
+	}
+	if referenceFetches.inFlight[ref] || now.Sub(referenceFetches.failed[ref]) < referenceRetryAfter {
+		referenceFetches.mu.Unlock()
+		return
+	}
+	referenceFetches.inFlight[ref] = true
+	referenceFetches.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), referenceTimeout)
+		defer cancel()
+
+		ok := fetchReference(ctx, client, ref)
+
+		referenceFetches.mu.Lock()
+		defer referenceFetches.mu.Unlock()
+
+		delete(referenceFetches.inFlight, ref)
+		for r, at := range referenceFetches.failed {
+			if time.Since(at) >= referenceRetryAfter {
+				delete(referenceFetches.failed, r)
+			}
+		}
+		if !ok {
+			referenceFetches.failed[ref] = time.Now()
+		}
+	}()
+}
+
+// fetchReference fetches the item ref points at from GitLab and stores it in
+// the cache. Items fetched this way hold no role, which keeps them out of the
+// lists across all projects, and a full sync drops them again unless they
+// show up in one of the synced lists.
+func fetchReference(ctx context.Context, client *gitlabClient, ref reference) bool {
+	var err error
+	switch ref.kind {
+	case kindProject:
+		var p Project
+		if p, err = client.fetchProject(ctx, ref.projectPath); err == nil {
+			err = upsertProjects(ctx, []Project{p})
+		}
+	case kindMR:
+		var mr MergeRequest
+		if mr, err = client.fetchMergeRequest(ctx, ref.projectPath, ref.iid); err == nil {
+			err = upsertMergeRequests(ctx, []MergeRequest{mr}, "")
+		}
+	case kindIssue:
+		var issue Issue
+		if issue, err = client.fetchIssue(ctx, ref.projectPath, ref.iid); err == nil {
+			err = applyIssues(ctx, []issueSet{{Issues: []Issue{issue}}}, false, time.Time{})
+		}
+	}
+
+	// A reference to something that doesn't exist, or that the token can't
+	// see, is an ordinary outcome of typing a query.
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		slog.Error(Name, "reference", fmt.Sprintf("%s %s %d: %v", ref.kind, ref.projectPath, ref.iid, err))
+		return false
+	}
+
+	if err := loadFuzzyIndex(); err != nil {
+		slog.Error(Name, "index", err)
+	}
+
+	return true
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/abenz1267/elephant/v2/pkg/common"
@@ -18,11 +22,17 @@ var (
 	Name       = "gitlab"
 	NamePretty = "GitLab"
 	config     *Config
-	client     *gitlabClient
-	userID     int64
 	h          *history.History
 )
 
+// apiClient and account are read by Query and State while Setup and syncUser
+// set them, so they are only accessed atomically. account is the user the
+// token belongs to, once syncUser has looked it up.
+var (
+	apiClient atomic.Pointer[gitlabClient]
+	account   atomic.Pointer[GitLabUser]
+)
+
 func Available() bool {
 	return true
 }
@@ -33,13 +43,22 @@ func LoadConfig() {
 			Icon:     "gitlab",
 			MinScore: 20,
 		},
-		GitLabURL:       "https://gitlab.com",
-		PATFile:         "~/.gitlab_pat",
-		RefreshInterval: 15,
-		MaxProjects:     1000,
-		MembershipOnly:  true,
-		History:         true,
-		Command:         "xdg-open",
+		GitLabURL:          "https://gitlab.com",
+		PATFile:            "~/.gitlab_pat",
+		RefreshInterval:    15,
+		MaxProjects:        1000,
+		MaxRetries:         5,
+		FetchConcurrency:   4,
+		FullSyncInterval:   360,
+		ProjectGracePeriod: 1440,
+		ClosedRetention:    14,
+		DrillDownProjects:  5,
+		ReadmeMaxAge:       1440,
+		PipelineProjects:   10,
+		MembershipOnly:     true,
+		IssuesMentioned:    false,
+		History:            true,
+		Command:            "xdg-open",
 	}
 
 	common.LoadConfig(Name, config)
@@ -58,80 +77,469 @@ func Setup() {
 	if pat == "" {
 		slog.Error(Name, "setup", "no PAT found, provider will serve cached data only")
 	}
+	setTokenMissing(pat == "")
 
 	if err := openDB(); err != nil {
 		slog.Error(Name, "setup", err)
 		return
 	}
 
-	if pat != "" {
-		client = newGitLabClient(config.GitLabURL, pat)
+	if err := loadFuzzyIndex(); err != nil {
+		slog.Error(Name, "setup", fmt.Sprintf("index: %v", err))
+	}
 
-		user, err := client.getCurrentUser()
-		if err != nil {
-			slog.Error(Name, "setup", fmt.Sprintf("failed to get current user: %v", err))
-		} else {
-			userID = user.ID
-			slog.Info(Name, "user", user.Username)
-		}
+	if pat != "" {
+		apiClient.Store(newGitLabClient(config.GitLabURL, pat, config.MaxRetries, config.FetchConcurrency))
 
-		go syncAll()
-		go backgroundRefresh()
+		syncs.request(syncBackground)
+		go backgroundRefresh(context.Background())
 	}
 }
 
-func syncAll() {
-	if client == nil {
+// syncPages counts the pages fetched by the running sync, for State.
+var syncPages atomic.Int64
+
+func syncAll(ctx context.Context) {
+	if apiClient.Load() == nil {
 		return
 	}
 
 	start := time.Now()
 	slog.Info(Name, "sync", "starting")
+	syncPages.Store(0)
+	ctx = countPages(ctx, &syncPages)
 
-	projects := client.fetchProjects(config.MaxProjects, config.MembershipOnly)
+	var syncErr error
+	for _, step := range []func(context.Context) error{syncUser, syncProjects, syncMergeRequests, syncIssues, syncTodos, syncPipelines} {
+		err := step(ctx)
+		if err == nil {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			slog.Info(Name, "sync", "cancelled")
+			break
+		}
+
+		slog.Error(Name, "sync", err.Error())
+		if syncErr == nil {
+			syncErr = err
+		}
+
+		// With a rejected token every other request fails the same way, and
+		// it's the error worth reporting over any earlier one.
+		if errors.Is(err, ErrUnauthorized) {
+			slog.Error(Name, "sync", "token rejected, check that the personal access token is valid and not expired")
+			syncErr = err
+			break
+		}
+	}
+
+	if ctx.Err() == nil {
+		if err := recordSyncResult(ctx, start, syncErr); err != nil {
+			slog.Error(Name, "sync", fmt.Sprintf("meta: %v", err))
+		}
+	}
+
+	if err := loadFuzzyIndex(); err != nil {
+		slog.Error(Name, "sync", fmt.Sprintf("index: %v", err))
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("done in %v", time.Since(start)))
+}
+
+// syncUser looks up the user the token belongs to, until that succeeds. Until
+// then the review queue can't be fetched, and approving isn't offered.
+func syncUser(ctx context.Context) error {
+	if account.Load() != nil {
+		return nil
+	}
+
+	user, err := apiClient.Load().getCurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("current user: %w", err)
+	}
+
+	account.Store(user)
+	slog.Info(Name, "user", user.Username)
+	return nil
+}
+
+// syncProjects fetches only projects with activity since the last successful
+// sync, falling back to a full fetch every FullSyncInterval minutes.
+func syncProjects(ctx context.Context) error {
+	client := apiClient.Load()
+
+	// GitLab only updates last_activity_at about once an hour, so overlap
+	// the window to avoid missing recently touched projects.
+	w := newSyncWindow(metaProjectsSyncedAt, metaProjectsFullSyncAt, fullSyncInterval(), time.Hour)
+
+	// Keep whatever was fetched before a failure; only the sync time and
+	// removals depend on a complete result.
+	projects, err := client.fetchProjects(ctx, config.MaxProjects, config.MembershipOnly, w.since)
 	if len(projects) > 0 {
-		if err := upsertProjects(projects); err != nil {
-			slog.Error(Name, "sync", fmt.Sprintf("projects: %v", err))
+		if err := upsertProjects(ctx, projects); err != nil {
+			return fmt.Errorf("projects: %w", err)
 		}
 	}
-	slog.Info(Name, "sync", fmt.Sprintf("fetched %d projects", len(projects)))
+	slog.Info(Name, "sync", fmt.Sprintf("fetched %d projects", len(projects)), "full", w.full)
+
+	if err != nil {
+		return fmt.Errorf("projects: %w", err)
+	}
+
+	// An empty full sync is more likely a permissions problem than every
+	// project being gone, so don't treat it as grounds for removal. Neither is
+	// one cut off at MaxProjects, which leaves out the least active projects.
+	if w.full && len(projects) > 0 && len(projects) < config.MaxProjects {
+		removeMissingProjects(ctx, projects, w.start)
+	}
+
+	w.done(ctx)
+	return nil
+}
+
+// syncMergeRequests fetches MRs updated since the last successful sync and
+// reconciles them by state. Every FullSyncInterval minutes it fetches all open
+// MRs instead and prunes the ones no longer returned, e.g. after being removed
+// as a reviewer.
+func syncMergeRequests(ctx context.Context) error {
+	client := apiClient.Load()
+	user := account.Load()
+
+	// Overlap the window to allow for clock skew between us and GitLab.
+	w := newSyncWindow(metaMRsSyncedAt, metaMRsFullSyncAt, fullSyncInterval(), time.Minute)
+
+	// Fetch every MR list before touching the cache, so that a failed
+	// request leaves the previous results in place instead of a partial set.
+	assigned, err := client.fetchAssignedMRs(ctx, w.since)
+	if err != nil {
+		return fmt.Errorf("assigned mrs: %w", err)
+	}
 
-	if err := clearMergeRequests(); err != nil {
-		slog.Error(Name, "sync", fmt.Sprintf("clear mrs: %v", err))
+	authored, err := client.fetchAuthoredMRs(ctx, w.since)
+	if err != nil {
+		return fmt.Errorf("authored mrs: %w", err)
 	}
 
-	assigned := client.fetchAssignedMRs()
-	if len(assigned) > 0 {
-		if err := upsertMergeRequests(assigned, "assigned"); err != nil {
-			slog.Error(Name, "sync", fmt.Sprintf("assigned mrs: %v", err))
+	// Without the user, which syncUser failed to look up, there is no
+	// review queue to fetch. The sets are then incomplete, so they mustn't
+	// prune the cached reviews or count as a sync of the window.
+	var reviewing []MergeRequest
+	complete := user != nil
+	if complete {
+		reviewing, err = client.fetchReviewingMRs(ctx, user.ID, w.since)
+		if err != nil {
+			return fmt.Errorf("reviewing mrs: %w", err)
 		}
 	}
 
-	authored := client.fetchAuthoredMRs()
-	if len(authored) > 0 {
-		if err := upsertMergeRequests(authored, "authored"); err != nil {
-			slog.Error(Name, "sync", fmt.Sprintf("authored mrs: %v", err))
+	// The MR lists don't include approvals. Fetch them once per MR and
+	// share the result between the lists an MR appears in. An MR whose
+	// approvals can't be fetched, e.g. one the token lost access to, keeps
+	// its cached approvals rather than holding up the rest.
+	cached, err := cachedApprovals()
+	if err != nil {
+		return fmt.Errorf("cached approvals: %w", err)
+	}
+	unique := uniqueMergeRequests(assigned, authored, reviewing)
+	for i := range unique {
+		unique[i].Approvals = cached[unique[i].ID]
+	}
+	if err := client.fetchApprovals(ctx, unique); err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrUnauthorized) {
+			return fmt.Errorf("approvals: %w", err)
 		}
+		slog.Warn(Name, "approvals", err)
+	}
+	approvals := make(map[int64]MRApprovals, len(unique))
+	for _, mr := range unique {
+		approvals[mr.ID] = mr.Approvals
+	}
+	for _, mrs := range [][]MergeRequest{assigned, authored, reviewing} {
+		for i := range mrs {
+			mrs[i].Approvals = approvals[mrs[i].ID]
+		}
+	}
+
+	sets := []mergeRequestSet{
+		{Role: roleAssigned, MRs: assigned},
+		{Role: roleAuthored, MRs: authored},
+		{Role: roleReviewing, MRs: reviewing},
+	}
+	if err := applyMergeRequests(ctx, sets, w.full && complete, closedCutoff(w.start)); err != nil {
+		return fmt.Errorf("mrs: %w", err)
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("fetched %d merge requests", len(assigned)+len(authored)+len(reviewing)), "full", w.full)
+
+	if complete {
+		w.done(ctx)
 	}
+	return nil
+}
+
+// syncIssues mirrors syncMergeRequests for issues assigned to or created by
+// the user and, with IssuesMentioned, those mentioning them.
+func syncIssues(ctx context.Context) error {
+	client := apiClient.Load()
+
+	// Overlap the window to allow for clock skew between us and GitLab.
+	w := newSyncWindow(metaIssuesSyncedAt, metaIssuesFullSyncAt, fullSyncInterval(), time.Minute)
+
+	assigned, err := client.fetchAssignedIssues(ctx, w.since)
+	if err != nil {
+		return fmt.Errorf("assigned issues: %w", err)
+	}
+
+	authored, err := client.fetchAuthoredIssues(ctx, w.since)
+	if err != nil {
+		return fmt.Errorf("authored issues: %w", err)
+	}
+
+	var mentioned []Issue
+	if config.IssuesMentioned {
+		mentioned, err = client.fetchMentionedIssues(ctx)
+		if err != nil {
+			return fmt.Errorf("mentioned issues: %w", err)
+		}
+	}
+
+	sets := []issueSet{
+		{Role: roleAssigned, Issues: assigned},
+		{Role: roleAuthored, Issues: authored},
+		{Role: roleMentioned, Issues: mentioned},
+	}
+	if err := applyIssues(ctx, sets, w.full, closedCutoff(w.start)); err != nil {
+		return fmt.Errorf("issues: %w", err)
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("fetched %d issues", len(assigned)+len(authored)+len(mentioned)), "full", w.full)
+
+	w.done(ctx)
+	return nil
+}
+
+// syncPipelines refreshes the pipeline status of every open MR and of the
+// default branch of the PipelineProjects most opened projects. Pipelines
+// finish without updating their MR, so the incremental MR sync can't be
+// relied on for this. Statuses that fail to fetch keep their cached value.
+func syncPipelines(ctx context.Context) error {
+	client := apiClient.Load()
 
-	if userID > 0 {
-		reviewing := client.fetchReviewingMRs(userID)
-		if len(reviewing) > 0 {
-			if err := upsertMergeRequests(reviewing, "reviewing"); err != nil {
-				slog.Error(Name, "sync", fmt.Sprintf("reviewing mrs: %v", err))
+	start := time.Now()
+
+	all, err := allMergeRequests()
+	if err != nil {
+		return fmt.Errorf("pipelines: %w", err)
+	}
+
+	// Only MRs updated since the last sync, e.g. by a push, can have a new
+	// pipeline. Those whose pipeline hadn't finished yet are checked again
+	// regardless. Overlap the window to allow for clock skew.
+	since, synced := getMetaTime(metaPipelinesSyncedAt)
+	since = since.Add(-time.Minute)
+
+	var mrs []dbMergeRequest
+	for _, mr := range all {
+		if mr.State != "opened" || mr.ProjectID == 0 {
+			continue
+		}
+		updated := time.Unix(max(mr.UpdatedAt, mr.CreatedAt), 0)
+		if !synced || updated.After(since) || !pipelineFinished(mr.PipelineStatus) {
+			mrs = append(mrs, mr)
+		}
+	}
+
+	var projects []dbProject
+	for _, p := range mostOpenedProjects(config.PipelineProjects) {
+		if p.DefaultBranch != "" {
+			projects = append(projects, p)
+		}
+	}
+
+	var mu sync.Mutex
+	byMR := make(map[int64]string, len(mrs))
+	byProject := make(map[int64]string, len(projects))
+
+	mrErr := client.forEach(ctx, len(mrs), func(i int) error {
+		status, err := client.fetchMergeRequestPipeline(ctx, mrs[i].ProjectID, mrs[i].IID)
+		if err != nil {
+			return fmt.Errorf("%s!%d: %w", mrs[i].ProjectPath, mrs[i].IID, err)
+		}
+		mu.Lock()
+		byMR[mrs[i].ID] = status
+		mu.Unlock()
+		return nil
+	})
+
+	projectErr := client.forEach(ctx, len(projects), func(i int) error {
+		status, err := client.fetchBranchPipeline(ctx, projects[i].ID, projects[i].DefaultBranch)
+		if err != nil {
+			return fmt.Errorf("%s: %w", projects[i].PathWithNamespace, err)
+		}
+		mu.Lock()
+		byProject[projects[i].ID] = status
+		mu.Unlock()
+		return nil
+	})
+
+	if err := setPipelineStatuses(ctx, byMR, byProject); err != nil {
+		return fmt.Errorf("pipelines: %w", err)
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("fetched %d pipelines", len(byMR)+len(byProject)))
+
+	if err := errors.Join(mrErr, projectErr); err != nil {
+		return fmt.Errorf("pipelines: %w", err)
+	}
+
+	if err := setMetaTime(ctx, metaPipelinesSyncedAt, start); err != nil {
+		slog.Error(Name, "sync", fmt.Sprintf("meta: %v", err))
+	}
+
+	return nil
+}
+
+// pipelineFinished reports whether a pipeline with status won't change
+// anymore without a new push. An empty status means none was seen yet.
+func pipelineFinished(status string) bool {
+	switch status {
+	case "", "created", "waiting_for_resource", "preparing", "pending", "running", "scheduled":
+		return false
+	}
+	return true
+}
+
+func fullSyncInterval() time.Duration {
+	return time.Duration(config.FullSyncInterval) * time.Minute
+}
+
+// syncWindow is the range of an incremental sync of one kind of item, tracked
+// by a pair of meta keys: when it was last synced, and last fully synced.
+type syncWindow struct {
+	syncedKey, fullKey string
+
+	start time.Time
+	full  bool
+
+	// since is zero for a full sync.
+	since time.Time
+}
+
+// newSyncWindow starts a sync that is full once fullInterval has passed since
+// the last full one, or when none completed before. Otherwise it covers what
+// changed since the last sync, overlapping it by overlap.
+func newSyncWindow(syncedKey, fullKey string, fullInterval, overlap time.Duration) syncWindow {
+	w := syncWindow{syncedKey: syncedKey, fullKey: fullKey, start: time.Now()}
+
+	lastFull, okFull := getMetaTime(fullKey)
+	last, ok := getMetaTime(syncedKey)
+	w.full = !okFull || !ok || w.start.Sub(lastFull) >= fullInterval
+	if !w.full {
+		w.since = last.Add(-overlap)
+	}
+
+	return w
+}
+
+// done records the sync as successful, so the next one starts from here.
+func (w syncWindow) done(ctx context.Context) {
+	if err := setMetaTime(ctx, w.syncedKey, w.start); err != nil {
+		slog.Error(Name, "sync", fmt.Sprintf("meta: %v", err))
+	}
+	if w.full {
+		if err := setMetaTime(ctx, w.fullKey, w.start); err != nil {
+			slog.Error(Name, "sync", fmt.Sprintf("meta: %v", err))
+		}
+	}
+}
+
+// uniqueMergeRequests returns the MRs of every list, without duplicates.
+func uniqueMergeRequests(lists ...[]MergeRequest) []MergeRequest {
+	var unique []MergeRequest
+	seen := make(map[int64]bool)
+	for _, mrs := range lists {
+		for _, mr := range mrs {
+			if !seen[mr.ID] {
+				seen[mr.ID] = true
+				unique = append(unique, mr)
 			}
 		}
 	}
+	return unique
+}
 
-	slog.Info(Name, "sync", fmt.Sprintf("done in %v", time.Since(start)))
+// closedCutoff returns the time before which merged and closed items are
+// pruned on a full sync.
+func closedCutoff(now time.Time) time.Time {
+	return now.Add(-time.Duration(config.ClosedRetention) * 24 * time.Hour)
+}
+
+// syncTodos replaces the cached to-do list with the pending to-dos.
+func syncTodos(ctx context.Context) error {
+	todos, err := apiClient.Load().fetchTodos(ctx)
+	if err != nil {
+		return fmt.Errorf("todos: %w", err)
+	}
+
+	if err := replaceTodos(ctx, todos); err != nil {
+		return fmt.Errorf("todos: %w", err)
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("fetched %d todos", len(todos)))
+
+	if err := setMetaTime(ctx, metaTodosSyncedAt, time.Now()); err != nil {
+		slog.Error(Name, "sync", fmt.Sprintf("meta: %v", err))
+	}
+
+	return nil
+}
+
+// removeMissingProjects drops projects that have been absent from full syncs
+// for longer than ProjectGracePeriod minutes, along with their history.
+func removeMissingProjects(ctx context.Context, seen []Project, now time.Time) {
+	ids := make([]int64, len(seen))
+	for i, p := range seen {
+		ids[i] = p.ID
+	}
+
+	cutoff := now.Add(-time.Duration(config.ProjectGracePeriod) * time.Minute)
+	removed, err := pruneProjects(ctx, ids, now, cutoff)
+	if err != nil {
+		slog.Error(Name, "sync", fmt.Sprintf("prune projects: %v", err))
+		return
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	slog.Info(Name, "sync", fmt.Sprintf("removed %d missing projects", len(removed)))
+
+	if h != nil {
+		for _, id := range removed {
+			h.Remove(fmt.Sprintf("project:%d", id))
+		}
+	}
 }
 
-func backgroundRefresh() {
-	ticker := time.NewTicker(time.Duration(config.RefreshInterval) * time.Minute)
+// backgroundRefresh requests a sync every RefreshInterval minutes, counting
+// from the last manual refresh if that was more recent.
+func backgroundRefresh(ctx context.Context) {
+	interval := time.Duration(config.RefreshInterval) * time.Minute
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		syncAll()
+	for {
+		select {
+		case <-ticker.C:
+			syncs.request(syncBackground)
+		case <-syncs.manual:
+			ticker.Reset(interval)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -152,6 +560,7 @@ func HideFromProviderlist() bool {
 
 func State(action string) *pb.ProviderStateResponse {
 	return &pb.ProviderStateResponse{
+		States:  syncStates(time.Now()),
 		Actions: []string{ActionRefresh},
 	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abenz1267/elephant/v2/pkg/pb/pb"
+)
+
+// syncedResources lists the meta keys holding when each kind of item was last
+// synced successfully, in the order State reports them.
+var syncedResources = []struct {
+	name string
+	key  string
+}{
+	{"projects", metaProjectsSyncedAt},
+	{"merge_requests", metaMRsSyncedAt},
+	{"issues", metaIssuesSyncedAt},
+	{"todos", metaTodosSyncedAt},
+	{"pipelines", metaPipelinesSyncedAt},
+}
+
+// health is what the status items in Query are based on. It's updated by
+// Setup and after every sync.
+var health struct {
+	sync.Mutex
+	tokenMissing  bool
+	tokenRejected bool
+	offline       bool
+}
+
+func setTokenMissing(missing bool) {
+	health.Lock()
+	health.tokenMissing = missing
+	health.Unlock()
+}
+
+func setTokenRejected(rejected bool) {
+	health.Lock()
+	health.tokenRejected = rejected
+	health.Unlock()
+}
+
+// recordSyncResult stores the outcome of a sync in meta so it survives
+// restarts, and updates health. A sync without errors clears the previous
+// error.
+func recordSyncResult(ctx context.Context, start time.Time, err error) error {
+	health.Lock()
+	health.tokenRejected = errors.Is(err, ErrUnauthorized)
+	health.offline = unreachable(err)
+	health.Unlock()
+
+	if err != nil {
+		if err := setMeta(ctx, metaLastError, errorSummary(err)); err != nil {
+			return err
+		}
+		return setMetaTime(ctx, metaLastErrorAt, time.Now())
+	}
+
+	if err := setMeta(ctx, metaLastError, ""); err != nil {
+		return err
+	}
+	return setMetaTime(ctx, metaLastSyncAt, start)
+}
+
+// errorSummary shortens err for display, e.g. "401 Unauthorized" rather than
+// the full request that failed.
+func errorSummary(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%d %s", apiErr.Status, http.StatusText(apiErr.Status))
+	}
+	return err.Error()
+}
+
+// unreachable reports whether err means GitLab couldn't be reached at all,
+// as opposed to answering a request with an error. A 5xx on one endpoint,
+// e.g. the approvals of a single MR, doesn't make the cache stale.
+func unreachable(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// lastSyncTime returns when the cache was last refreshed. A sync that failed
+// part way still refreshed some kinds of items, so the newest of those counts
+// too.
+func lastSyncTime() (time.Time, bool) {
+	last, synced := getMetaTime(metaLastSyncAt)
+	for _, r := range syncedResources {
+		if t, ok := getMetaTime(r.key); ok && (!synced || t.After(last)) {
+			last, synced = t, true
+		}
+	}
+	return last, synced
+}
+
+// syncStates describes the sync state for State, as "key:value" strings:
+//
+//	idle | syncing        whether a sync is running
+//	pages:12              pages fetched by the running sync
+//	synced:projects:1700000000
+//	                      last successful sync of each kind of item
+//	error:401 Unauthorized
+//	error_at:1700000000   the error of the last sync, if it had one
+//	summary:last synced 12 min ago — 401 Unauthorized
+func syncStates(now time.Time) []string {
+	var states, summary []string
+
+	if syncs.inProgress() {
+		states = append(states, "syncing")
+		pages := syncPages.Load()
+		states = append(states, fmt.Sprintf("pages:%d", pages))
+		summary = append(summary, fmt.Sprintf("syncing, %d pages fetched", pages))
+	} else {
+		states = append(states, "idle")
+	}
+
+	for _, r := range syncedResources {
+		if t, ok := getMetaTime(r.key); ok {
+			states = append(states, "synced:"+r.name+":"+strconv.FormatInt(t.Unix(), 10))
+		}
+	}
+
+	if last, synced := lastSyncTime(); synced {
+		summary = append(summary, "last synced "+ago(now.Sub(last)))
+	} else {
+		summary = append(summary, "never synced")
+	}
+
+	if msg, _ := getMeta(metaLastError); msg != "" {
+		states = append(states, "error:"+msg)
+		if t, ok := getMetaTime(metaLastErrorAt); ok {
+			states = append(states, "error_at:"+strconv.FormatInt(t.Unix(), 10))
+		}
+		summary = append(summary, msg)
+	}
+
+	return append(states, "summary:"+strings.Join(summary, " — "))
+}
+
+// Identifiers of the status items, which all start with statusPrefix.
+const (
+	statusPrefix  = "status:"
+	statusToken   = statusPrefix + "token"
+	statusOffline = statusPrefix + "offline"
+)
+
+// statusScore ranks status items above any search result.
+const statusScore = 1 << 30
+
+// statusEntries returns items explaining why results may be missing or
+// stale: a missing or rejected token, which opens the token settings, or
+// GitLab being unreachable, which offers a refresh.
+func statusEntries(now time.Time) []*pb.QueryResponse_Item {
+	health.Lock()
+	missing, rejected, offline := health.tokenMissing, health.tokenRejected, health.offline
+	health.Unlock()
+
+	var entries []*pb.QueryResponse_Item
+
+	switch {
+	case missing:
+		entries = append(entries, statusEntry(statusToken, "GitLab token missing — open token settings",
+			fmt.Sprintf("No personal access token in %s, only cached results are shown", config.PATFile),
+			"dialog-warning", ActionOpen))
+	case rejected:
+		entries = append(entries, statusEntry(statusToken, "GitLab token expired or revoked — open token settings",
+			fmt.Sprintf("Create a new token and save it to %s, only cached results are shown", config.PATFile),
+			"dialog-warning", ActionOpen))
+	case offline:
+		age := "the cache is empty"
+		if last, ok := lastSyncTime(); ok {
+			age = "showing results cached " + ago(now.Sub(last))
+		}
+		entries = append(entries, statusEntry(statusOffline, "GitLab unreachable — "+age,
+			fmt.Sprintf("%s could not be reached during the last sync", config.GitLabURL),
+			"network-offline", ActionRefresh))
+	}
+
+	return entries
+}
+
+func statusEntry(identifier, text, subtext, icon, action string) *pb.QueryResponse_Item {
+	return &pb.QueryResponse_Item{
+		Identifier: identifier,
+		Text:       text,
+		Subtext:    subtext,
+		Icon:       icon,
+		Provider:   Name,
+		Type:       pb.QueryResponse_REGULAR,
+		Actions:    []string{action},
+		Score:      statusScore,
+	}
+}
+
+// tokenSettingsURL returns the page of the GitLab instance for managing
+// personal access tokens.
+func tokenSettingsURL() string {
+	return strings.TrimSuffix(config.GitLabURL, "/") + "/-/user_settings/personal_access_tokens"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+)
+
+type dbTodo struct {
+	ID              int64
+	ActionName      string
+	TargetType      string
+	TargetTitle     string
+	TargetReference string
+	TargetURL       string
+	ProjectPath     string
+	Author          string
+	Body            string
+	CreatedAt       int64
+}
+
+// replaceTodos swaps the cached to-do list for todos in one transaction. The
+// pending list is small, so it is always fetched in full.
+func replaceTodos(ctx context.Context, todos []Todo) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM todos"); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO todos
+		(id, action_name, target_type, target_title, target_reference, target_url, project_path, author, body, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, t := range todos {
+		_, err = stmt.Exec(t.ID, t.ActionName, t.TargetType, t.Target.Title, t.Target.References.Full, t.TargetURL,
+			t.Project.PathWithNamespace, t.Author.Username, t.Body, t.CreatedAt.Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func deleteTodo(id string) error {
+	_, err := db.Exec("DELETE FROM todos WHERE id = ?", id)
+	return err
+}
+
+func queryTodos() []dbTodo {
+	rows, err := db.Query(`SELECT id, action_name, target_type, target_title, target_reference, target_url, project_path, author, body, created_at
+		FROM todos ORDER BY created_at DESC`)
+	if err != nil {
+		slog.Error(Name, "querytodos", err)
+		return nil
+	}
+
+	return scanTodos(rows)
+}
+
+func scanTodos(rows *sql.Rows) []dbTodo {
+	defer rows.Close()
+
+	var result []dbTodo
+	for rows.Next() {
+		var t dbTodo
+		if err := rows.Scan(&t.ID, &t.ActionName, &t.TargetType, &t.TargetTitle, &t.TargetReference, &t.TargetURL,
+			&t.ProjectPath, &t.Author, &t.Body, &t.CreatedAt); err != nil {
+			continue
+		}
+		result = append(result, t)
+	}
+
+	return result
+}
+
+func getTodoTargetURL(id string) string {
+	var url string
+	err := db.QueryRow("SELECT target_url FROM todos WHERE id = ?", id).Scan(&url)
+	if err != nil {
+		return ""
+	}
+	return url
+}